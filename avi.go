@@ -0,0 +1,209 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	aviFlagHasIndex = 0x10 // AVIF_HASINDEX
+	aviFlagKeyFrame = 0x10 // AVIIF_KEYFRAME
+
+	// RIFF sizes are 32 bits, stop before reaching the limit
+	aviMaxSize = 0xf0000000
+)
+
+var errAVITooLarge = errors.New("spice: recording reached the maximum AVI file size")
+
+// aviWriter writes an AVI 1.0 file with a MJPEG video stream and an
+// optional 16 bits PCM audio stream. Sizes and counts in the headers are
+// written once the file is closed.
+type aviWriter struct {
+	w        io.WriteSeeker
+	channels int // audio channels, 0 if no audio
+	freq     int
+
+	pos     int64        // current offset in the file
+	movi    int64        // offset of the "movi" list type
+	fields  aviFields    // offsets of header fields updated on close
+	index   bytes.Buffer // idx1 entries
+	frames  uint32
+	samples uint32
+	maxSize uint32 // largest chunk
+}
+
+type aviFields struct {
+	riffSize, moviSize       int64
+	totalFrames, bufferSize  int64
+	videoLength, audioLength int64
+}
+
+// newAVIWriter writes the headers of an AVI file of width*height frames at
+// fps frames per second
+func newAVIWriter(w io.WriteSeeker, width, height, fps, channels, freq int) (*aviWriter, error) {
+	a := &aviWriter{w: w, channels: channels, freq: freq}
+	streams := 1
+	if channels > 0 {
+		streams = 2
+	}
+
+	var h bytes.Buffer
+	le := func(v ...interface{}) {
+		for _, e := range v {
+			binary.Write(&h, binary.LittleEndian, e)
+		}
+	}
+	at := func() int64 { return int64(h.Len()) }
+
+	h.WriteString("RIFF")
+	a.fields.riffSize = at()
+	le(uint32(0))
+	h.WriteString("AVI LIST")
+	hdrlSize := at()
+	le(uint32(0))
+	h.WriteString("hdrl")
+
+	// MainAVIHeader
+	h.WriteString("avih")
+	le(uint32(56), uint32(1000000/fps), uint32(0), uint32(0), uint32(aviFlagHasIndex))
+	a.fields.totalFrames = at()
+	le(uint32(0), uint32(0), uint32(streams))
+	a.fields.bufferSize = at()
+	le(uint32(0), uint32(width), uint32(height), [4]uint32{})
+
+	// video stream: AVIStreamHeader and BITMAPINFOHEADER
+	h.WriteString("LIST")
+	le(uint32(4 + 8 + 56 + 8 + 40))
+	h.WriteString("strlstrh")
+	le(uint32(56))
+	h.WriteString("vidsMJPG")
+	le(uint32(0), uint16(0), uint16(0), uint32(0), uint32(1), uint32(fps), uint32(0))
+	a.fields.videoLength = at()
+	le(uint32(0), uint32(0), int32(-1), uint32(0), [4]int16{0, 0, int16(width), int16(height)})
+	h.WriteString("strf")
+	le(uint32(40), uint32(40), int32(width), int32(height), uint16(1), uint16(24))
+	h.WriteString("MJPG")
+	le(uint32(width*height*3), int32(0), int32(0), uint32(0), uint32(0))
+
+	if channels > 0 {
+		// audio stream: AVIStreamHeader and WAVEFORMATEX
+		align := channels * 2
+		h.WriteString("LIST")
+		le(uint32(4 + 8 + 56 + 8 + 18))
+		h.WriteString("strlstrh")
+		le(uint32(56))
+		h.WriteString("auds")
+		le(uint32(0), uint32(0), uint16(0), uint16(0), uint32(0), uint32(1), uint32(freq), uint32(0))
+		a.fields.audioLength = at()
+		le(uint32(0), uint32(freq*align/10), int32(-1), uint32(align), [4]int16{})
+		h.WriteString("strf")
+		le(uint32(18), uint16(1), uint16(channels), uint32(freq), uint32(freq*align), uint16(align), uint16(16), uint16(0))
+	}
+	binary.LittleEndian.PutUint32(h.Bytes()[hdrlSize:], uint32(at()-hdrlSize-4))
+
+	h.WriteString("LIST")
+	a.fields.moviSize = at()
+	le(uint32(0))
+	a.movi = at()
+	h.WriteString("movi")
+
+	if _, err := w.Write(h.Bytes()); err != nil {
+		return nil, err
+	}
+	a.pos = int64(h.Len())
+	return a, nil
+}
+
+// writeChunk adds a chunk to the movi list and the index
+func (a *aviWriter) writeChunk(id string, data []byte) error {
+	if a.pos+8+int64(len(data))+1+int64(a.index.Len())+16 > aviMaxSize {
+		return errAVITooLarge
+	}
+
+	binary.Write(&a.index, binary.LittleEndian, []byte(id))
+	binary.Write(&a.index, binary.LittleEndian, []uint32{aviFlagKeyFrame, uint32(a.pos - a.movi), uint32(len(data))})
+
+	hdr := make([]byte, 8)
+	copy(hdr, id)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(data)))
+	if len(data)%2 == 1 {
+		data = append(data[:len(data):len(data)], 0)
+	}
+	if _, err := a.w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+	a.pos += int64(len(hdr) + len(data))
+	if uint32(len(data)) > a.maxSize {
+		a.maxSize = uint32(len(data))
+	}
+	return nil
+}
+
+// writeFrame adds a JPEG frame to the video stream
+func (a *aviWriter) writeFrame(jpg []byte) error {
+	if err := a.writeChunk("00dc", jpg); err != nil {
+		return err
+	}
+	a.frames++
+	return nil
+}
+
+// writeAudio adds interleaved samples to the audio stream
+func (a *aviWriter) writeAudio(pcm []int16) error {
+	if a.channels == 0 || len(pcm) == 0 {
+		return nil
+	}
+	buf := make([]byte, len(pcm)*2)
+	for i, s := range pcm {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(s))
+	}
+	if err := a.writeChunk("01wb", buf); err != nil {
+		return err
+	}
+	a.samples += uint32(len(pcm) / a.channels)
+	return nil
+}
+
+// close writes the index and updates the headers
+func (a *aviWriter) close() error {
+	moviSize := a.pos - a.movi
+	hdr := make([]byte, 8)
+	copy(hdr, "idx1")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(a.index.Len()))
+	if _, err := a.w.Write(append(hdr, a.index.Bytes()...)); err != nil {
+		return err
+	}
+	a.pos += int64(len(hdr) + a.index.Len())
+
+	fields := []struct {
+		at int64
+		v  uint32
+	}{
+		{a.fields.riffSize, uint32(a.pos - 8)},
+		{a.fields.moviSize, uint32(moviSize)},
+		{a.fields.totalFrames, a.frames},
+		{a.fields.bufferSize, a.maxSize},
+		{a.fields.videoLength, a.frames},
+	}
+	if a.channels > 0 {
+		fields = append(fields, struct {
+			at int64
+			v  uint32
+		}{a.fields.audioLength, a.samples})
+	}
+	for _, f := range fields {
+		if _, err := a.w.Seek(f.at, io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(a.w, binary.LittleEndian, f.v); err != nil {
+			return err
+		}
+	}
+	_, err := a.w.Seek(a.pos, io.SeekStart)
+	return err
+}
@@ -5,9 +5,41 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 )
 
-func bitmapImage(data []byte) (image.Image, error) {
+// paletted returns true for formats using a palette
+func (t BitmapImageType) paletted() bool {
+	switch t {
+	case BITMAP_IMAGE_TYPE_1BIT_LE, BITMAP_IMAGE_TYPE_1BIT_BE, BITMAP_IMAGE_TYPE_4BIT_LE, BITMAP_IMAGE_TYPE_4BIT_BE, BITMAP_IMAGE_TYPE_8BIT:
+		return true
+	}
+	return false
+}
+
+// bits returns the number of bits per pixel of the format
+func (t BitmapImageType) bits() int {
+	switch t {
+	case BITMAP_IMAGE_TYPE_1BIT_LE, BITMAP_IMAGE_TYPE_1BIT_BE:
+		return 1
+	case BITMAP_IMAGE_TYPE_4BIT_LE, BITMAP_IMAGE_TYPE_4BIT_BE:
+		return 4
+	case BITMAP_IMAGE_TYPE_8BIT, BITMAP_IMAGE_TYPE_8BIT_A:
+		return 8
+	case BITMAP_IMAGE_TYPE_16BIT:
+		return 16
+	case BITMAP_IMAGE_TYPE_24BIT:
+		return 24
+	case BITMAP_IMAGE_TYPE_32BIT, BITMAP_IMAGE_TYPE_RGBA:
+		return 32
+	}
+	return 0
+}
+
+// bitmapImage decodes a SpiceBitmap. Paletted formats need the palette the
+// bitmap references (inline or from the palette cache), resolved by the
+// caller.
+func bitmapImage(data []byte, palette []color.RGBA) (image.Image, error) {
 	if len(data) < 2 {
 		return nil, errors.New("not enough data for bitmap image")
 	}
@@ -15,8 +47,10 @@ func bitmapImage(data []byte) (image.Image, error) {
 	format := BitmapImageType(data[0])
 	flags := data[1] // 1=PAL_CACHE_ME, 2=PAL_FROM_CACHE, 4=TOP_DOWN,
 
+	// the palette pointer (or palette id if PAL_FROM_CACHE) follows the
+	// header, the caller uses it to find the palette
 	var headerLen int
-	if flags&2 == 2 {
+	if flags&SPICE_BITMAP_FLAGS_PAL_FROM_CACHE != 0 {
 		headerLen = 22
 	} else {
 		headerLen = 18
@@ -26,49 +60,85 @@ func bitmapImage(data []byte) (image.Image, error) {
 		return nil, errors.New("not enough data for bitmap image")
 	}
 
-	width := binary.LittleEndian.Uint32(data[2:6])
-	height := binary.LittleEndian.Uint32(data[6:10])
-	stride := binary.LittleEndian.Uint32(data[10:14])
-
-	var palId uint64
-	var palPtr uint32
-	if flags&2 == 2 { // PAL_FROM_CACHE
-		// palette_id
-		palId = binary.LittleEndian.Uint64(data[14:22])
-	} else {
-		// ptr to palette
-		palPtr = binary.LittleEndian.Uint32(data[14:18])
-	}
+	width := int(binary.LittleEndian.Uint32(data[2:6]))
+	height := int(binary.LittleEndian.Uint32(data[6:10]))
+	stride := int(binary.LittleEndian.Uint32(data[10:14]))
 
 	data = data[headerLen:]
 
-	//log.Printf("bitmap image, size=%dx%d stride=%d flags=%d format=%d palId=%d palPtr=%d len=%d", width, height, stride, flags, format, palId, palPtr, len(data))
-	_, _ = palId, palPtr
+	//log.Printf("bitmap image, size=%dx%d stride=%d flags=%d format=%d len=%d", width, height, stride, flags, format, len(data))
 
-	switch format {
-	case BITMAP_IMAGE_TYPE_32BIT, BITMAP_IMAGE_TYPE_RGBA:
-		ln := int(height * stride)
-		if len(data) < ln {
-			return nil, errors.New("not enough data for image")
-		}
+	bits := format.bits()
+	if bits == 0 {
+		return nil, fmt.Errorf("unsupported bitmap image format=%d size=%d,%d stride=%d", format, width, height, stride)
+	}
+	if format.paletted() && palette == nil {
+		return nil, fmt.Errorf("no palette for bitmap image format=%d", format)
+	}
+	if uint64(width)*uint64(height) > 64*1024*1024 {
+		return nil, errors.New("bitmap image too large")
+	}
+	if uint64(stride)*8 < uint64(width)*uint64(bits) {
+		return nil, errors.New("stride too small for bitmap image")
+	}
+	if uint64(len(data)) < uint64(height)*uint64(stride) {
+		return nil, errors.New("not enough data for image")
+	}
 
-		// QEMU sends bitmap data in BGRX format, need to convert to RGBA
-		pixData := make([]byte, ln)
-		for i := 0; i < ln; i += 4 {
-			pixData[i+0] = data[i+2] // R from B
-			pixData[i+1] = data[i+1] // G stays
-			pixData[i+2] = data[i+0] // B from R
-			pixData[i+3] = 0xff      // A (opaque)
-		}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := data[y*stride:]
+		out := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			o := out[x*4 : x*4+4]
 
-		img := &image.RGBA{Pix: pixData, Stride: int(stride), Rect: image.Rect(0, 0, int(width), int(height))}
+			if format.paletted() {
+				var idx byte
+				switch format {
+				case BITMAP_IMAGE_TYPE_1BIT_LE:
+					idx = row[x/8] >> (x % 8) & 1
+				case BITMAP_IMAGE_TYPE_1BIT_BE:
+					idx = row[x/8] >> (7 - x%8) & 1
+				case BITMAP_IMAGE_TYPE_4BIT_LE:
+					idx = row[x/2] >> (4 * (x % 2)) & 0x0f
+				case BITMAP_IMAGE_TYPE_4BIT_BE:
+					idx = row[x/2] >> (4 * (1 - x%2)) & 0x0f
+				default:
+					idx = row[x]
+				}
+				if int(idx) >= len(palette) {
+					return nil, fmt.Errorf("palette index %d out of range", idx)
+				}
+				c := palette[idx]
+				o[0], o[1], o[2], o[3] = c.R, c.G, c.B, 0xff
+				continue
+			}
 
-		if flags&4 == 0 {
-			// reverse image (flip vertically)
-			reverseImgRGBA(img)
+			switch format {
+			case BITMAP_IMAGE_TYPE_8BIT_A:
+				// alpha only, used as a mask
+				o[3] = row[x]
+			case BITMAP_IMAGE_TYPE_16BIT:
+				// x1r5g5b5
+				p := binary.LittleEndian.Uint16(row[x*2:])
+				r, g, b := uint8(p>>10)&0x1f, uint8(p>>5)&0x1f, uint8(p)&0x1f
+				o[0], o[1], o[2], o[3] = r<<3|r>>2, g<<3|g>>2, b<<3|b>>2, 0xff
+			case BITMAP_IMAGE_TYPE_24BIT:
+				// BGR
+				o[0], o[1], o[2], o[3] = row[x*3+2], row[x*3+1], row[x*3], 0xff
+			case BITMAP_IMAGE_TYPE_32BIT:
+				// QEMU sends bitmap data in BGRX format
+				o[0], o[1], o[2], o[3] = row[x*4+2], row[x*4+1], row[x*4], 0xff
+			case BITMAP_IMAGE_TYPE_RGBA:
+				// BGRA, premultiplied like image.RGBA
+				o[0], o[1], o[2], o[3] = row[x*4+2], row[x*4+1], row[x*4], row[x*4+3]
+			}
 		}
-		return img, nil
-	default:
-		return nil, fmt.Errorf("unsupported bitmap image format=%d size=%d,%d stride=%d", format, width, height, stride)
 	}
+
+	if flags&SPICE_BITMAP_FLAGS_TOP_DOWN == 0 {
+		// reverse image (flip vertically)
+		reverseImgRGBA(img)
+	}
+	return img, nil
 }
@@ -0,0 +1,66 @@
+package spice
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitmapFormats(t *testing.T) {
+	tests := []struct {
+		format BitmapImageType
+		stride uint32
+		pixel  []byte
+		want   color.RGBA
+	}{
+		{BITMAP_IMAGE_TYPE_16BIT, 2, []byte{0x1f, 0x7c}, color.RGBA{0xff, 0, 0xff, 0xff}},
+		{BITMAP_IMAGE_TYPE_24BIT, 3, []byte{0x30, 0x20, 0x10}, color.RGBA{0x10, 0x20, 0x30, 0xff}},
+		{BITMAP_IMAGE_TYPE_32BIT, 4, []byte{0x30, 0x20, 0x10, 0x00}, color.RGBA{0x10, 0x20, 0x30, 0xff}},
+		{BITMAP_IMAGE_TYPE_RGBA, 4, []byte{0x30, 0x20, 0x10, 0x80}, color.RGBA{0x10, 0x20, 0x30, 0x80}},
+		{BITMAP_IMAGE_TYPE_8BIT_A, 1, []byte{0x80}, color.RGBA{0, 0, 0, 0x80}},
+	}
+	for _, tt := range tests {
+		data := (&testMsg{}).put(uint8(tt.format), uint8(SPICE_BITMAP_FLAGS_TOP_DOWN), uint32(1), uint32(1), tt.stride, uint32(0))
+		data.Write(tt.pixel)
+
+		img, err := bitmapImage(data.Bytes(), nil)
+		if !assert.Nil(t, err, "format %d", tt.format) {
+			continue
+		}
+		assert.Equal(t, tt.want, img.(*image.RGBA).RGBAAt(0, 0), "format %d", tt.format)
+	}
+
+	// paletted formats need a palette
+	data := (&testMsg{}).put(uint8(BITMAP_IMAGE_TYPE_8BIT), uint8(0), uint32(1), uint32(1), uint32(1), uint32(0), uint8(0))
+	_, err := bitmapImage(data.Bytes(), nil)
+	assert.NotNil(t, err)
+
+	// truncated data
+	data = (&testMsg{}).put(uint8(BITMAP_IMAGE_TYPE_32BIT), uint8(0), uint32(2), uint32(2), uint32(8), uint32(0), uint32(0))
+	_, err = bitmapImage(data.Bytes(), nil)
+	assert.NotNil(t, err)
+}
+
+func TestBitmapPaletteImage(t *testing.T) {
+	pal := []color.RGBA{{0, 0, 0, 0xff}, {0xff, 0xff, 0xff, 0xff}}
+
+	// 1 bit big endian, 3x2 bottom up: first row stored last
+	data := (&testMsg{}).put(uint8(BITMAP_IMAGE_TYPE_1BIT_BE), uint8(0), uint32(3), uint32(2), uint32(1), uint32(0))
+	data.Write([]byte{0x40, 0xa0})
+
+	img, err := bitmapImage(data.Bytes(), pal)
+	if !assert.Nil(t, err) {
+		return
+	}
+	rgba := img.(*image.RGBA)
+	assert.Equal(t, pal[1], rgba.RGBAAt(0, 0))
+	assert.Equal(t, pal[0], rgba.RGBAAt(1, 0))
+	assert.Equal(t, pal[1], rgba.RGBAAt(2, 0))
+	assert.Equal(t, pal[1], rgba.RGBAAt(1, 1))
+
+	// palette index past the end of the palette
+	_, err = bitmapImage(data.Bytes(), pal[:1])
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,133 @@
+package spice
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	SPICE_IMAGE_FLAGS_CACHE_ME         = 1
+	SPICE_IMAGE_FLAGS_HIGH_BITS_SET    = 2
+	SPICE_IMAGE_FLAGS_CACHE_REPLACE_ME = 4
+
+	SPICE_RES_TYPE_PIXMAP = 1
+
+	// pixmap cache size announced in SPICE_MSGC_DISPLAY_INIT, in pixels
+	displayPixmapCacheSize = 80 * 1024 * 1024 / 4
+	// pixmap cache shared by all display channels
+	displayPixmapCacheID = 1
+
+	// how long to wait for an image to be cached by another display channel
+	cacheWaitTimeout = 2 * time.Second
+)
+
+// imageCache is the pixmap cache shared by the display channels of a
+// session. The server keeps track of the cache content and sizes it in
+// pixels; entries are removed on its request, the LRU eviction only exists
+// to keep memory bounded if both sides disagree.
+type imageCache struct {
+	lk    sync.Mutex
+	cond  *sync.Cond
+	max   int64 // maximum size in pixels
+	size  int64 // current size in pixels
+	items map[uint64]*list.Element
+	lru   *list.List // most recently used first
+}
+
+type cacheItem struct {
+	id    uint64
+	img   *Image
+	lossy bool
+	size  int64
+}
+
+func newImageCache(max int64) *imageCache {
+	c := &imageCache{
+		max:   max,
+		items: make(map[uint64]*list.Element),
+		lru:   list.New(),
+	}
+	c.cond = sync.NewCond(&c.lk)
+	return c
+}
+
+// put adds or replaces an image in the cache
+func (c *imageCache) put(id uint64, img *Image, lossy bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if e, ok := c.items[id]; ok {
+		c.removeElement(e)
+	}
+
+	b := img.Bounds()
+	it := &cacheItem{id: id, img: img, lossy: lossy, size: int64(b.Dx()) * int64(b.Dy())}
+	for c.size+it.size > c.max && c.lru.Len() > 0 {
+		old := c.lru.Back().Value.(*cacheItem)
+		log.Printf("spice/display: pixmap cache full, evicting image %d", old.id)
+		c.removeElement(c.lru.Back())
+	}
+
+	c.items[id] = c.lru.PushFront(it)
+	c.size += it.size
+	c.cond.Broadcast()
+}
+
+// get returns a cached image, waiting for a short while in case another
+// display channel is about to add it. If lossless is set, a lossy image is
+// considered an error.
+func (c *imageCache) get(id uint64, lossless bool) (*Image, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	var timedOut bool
+	t := time.AfterFunc(cacheWaitTimeout, func() {
+		c.lk.Lock()
+		timedOut = true
+		c.cond.Broadcast()
+		c.lk.Unlock()
+	})
+	defer t.Stop()
+
+	for {
+		if e, ok := c.items[id]; ok {
+			it := e.Value.(*cacheItem)
+			if lossless && it.lossy {
+				return nil, fmt.Errorf("cached image %d is lossy", id)
+			}
+			c.lru.MoveToFront(e)
+			return it.img, nil
+		}
+		if timedOut {
+			return nil, fmt.Errorf("image %d not found in cache", id)
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *imageCache) remove(id uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if e, ok := c.items[id]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *imageCache) clear() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.items = make(map[uint64]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *imageCache) removeElement(e *list.Element) {
+	it := c.lru.Remove(e).(*cacheItem)
+	delete(c.items, it.id)
+	c.size -= it.size
+}
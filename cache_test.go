@@ -0,0 +1,70 @@
+package spice
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testImage(id uint64, w, h int) *Image {
+	return &Image{Image: image.NewRGBA(image.Rect(0, 0, w, h)), ID: id}
+}
+
+func TestImageCache(t *testing.T) {
+	c := newImageCache(100)
+
+	c.put(1, testImage(1, 5, 5), false)
+	c.put(2, testImage(2, 5, 5), true)
+
+	img, err := c.get(1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), img.ID)
+
+	// lossy image requested as lossless
+	_, err = c.get(2, true)
+	assert.NotNil(t, err)
+	_, err = c.get(2, false)
+	assert.Nil(t, err)
+
+	// 2 was used last, adding 60 pixels evicts 1
+	c.put(3, testImage(3, 6, 10), false)
+	assert.Equal(t, int64(85), c.size)
+	_, ok := c.items[1]
+	assert.False(t, ok)
+
+	c.remove(2)
+	assert.Equal(t, int64(60), c.size)
+
+	c.clear()
+	assert.Equal(t, int64(0), c.size)
+	assert.Equal(t, 0, c.lru.Len())
+}
+
+func TestImageCacheWait(t *testing.T) {
+	c := newImageCache(100)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.put(7, testImage(7, 1, 1), false)
+	}()
+
+	img, err := c.get(7, false)
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint64(7), img.ID)
+	}
+}
+
+func TestDisplayInvalList(t *testing.T) {
+	d := newTestDisplay()
+	d.cl.pixmaps.put(1, testImage(1, 1, 1), false)
+	d.cl.pixmaps.put(2, testImage(2, 1, 1), false)
+
+	m := (&testMsg{}).put(uint16(1), uint8(SPICE_RES_TYPE_PIXMAP), uint64(1))
+	d.handle(SPICE_MSG_DISPLAY_INVAL_LIST, m.Bytes())
+	assert.Len(t, d.cl.pixmaps.items, 1)
+
+	d.handle(SPICE_MSG_DISPLAY_INVAL_ALL_PIXMAPS, nil)
+	assert.Len(t, d.cl.pixmaps.items, 0)
+}
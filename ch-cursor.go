@@ -29,6 +29,7 @@ const (
 type ChCursor struct {
 	cl   *Client
 	conn *SpiceConn
+	id   uint8 // display this cursor belongs to
 }
 
 type cursorInfo struct {
@@ -44,7 +45,7 @@ func (cl *Client) setupCursor(id uint8) (*ChCursor, error) {
 	if err != nil {
 		return nil, err
 	}
-	m := &ChCursor{cl: cl, conn: conn}
+	m := &ChCursor{cl: cl, conn: conn, id: id}
 	conn.hndlr = m.handle
 
 	go m.conn.ReadLoop()
@@ -72,7 +73,7 @@ func (d *ChCursor) handle(typ uint16, data []byte) {
 
 		if vis == 0 {
 			// invisible cursor
-			d.cl.driver.SetCursor(image.NewRGBA(image.Rectangle{Max: image.Point{16, 16}}), 0, 0)
+			d.cl.setCursor(d.id, image.NewRGBA(image.Rectangle{Max: image.Point{16, 16}}), 0, 0)
 			return
 		}
 
@@ -80,13 +81,13 @@ func (d *ChCursor) handle(typ uint16, data []byte) {
 		if err != nil {
 			log.Printf("spice/cursor: failed to read cursor: %s", err)
 		} else if cur != nil {
-			d.cl.driver.SetCursor(cur.im, cur.hotX, cur.hotY)
+			d.cl.setCursor(d.id, cur.im, cur.hotX, cur.hotY)
 		} else {
-			d.cl.driver.SetCursor(nil, 0, 0)
+			d.cl.setCursor(d.id, nil, 0, 0)
 		}
 	case SPICE_MSG_CURSOR_RESET:
 		// empty
-		d.cl.driver.SetCursor(nil, 0, 0)
+		d.cl.setCursor(d.id, nil, 0, 0)
 	case SPICE_MSG_CURSOR_MOVE:
 		// ignore
 	case SPICE_MSG_CURSOR_SET:
@@ -105,7 +106,7 @@ func (d *ChCursor) handle(typ uint16, data []byte) {
 
 		if vis == 0 {
 			// invisible cursor
-			d.cl.driver.SetCursor(image.NewRGBA(image.Rectangle{Max: image.Point{16, 16}}), 0, 0)
+			d.cl.setCursor(d.id, image.NewRGBA(image.Rectangle{Max: image.Point{16, 16}}), 0, 0)
 			return
 		}
 
@@ -113,12 +114,12 @@ func (d *ChCursor) handle(typ uint16, data []byte) {
 		if err != nil {
 			log.Printf("spice/cursor: failed to read cursor: %s", err)
 		} else if cur == nil {
-			d.cl.driver.SetCursor(nil, 0, 0)
+			d.cl.setCursor(d.id, nil, 0, 0)
 		} else {
-			d.cl.driver.SetCursor(cur.im, cur.hotX, cur.hotY)
+			d.cl.setCursor(d.id, cur.im, cur.hotX, cur.hotY)
 		}
 	case SPICE_MSG_CURSOR_HIDE:
-		d.cl.driver.SetCursor(nil, 0, 0)
+		d.cl.setCursor(d.id, nil, 0, 0)
 	case SPICE_MSG_CURSOR_INVAL_ALL:
 		// TODO clear cache
 	default:
@@ -127,12 +128,18 @@ func (d *ChCursor) handle(typ uint16, data []byte) {
 }
 
 func (d *ChCursor) decodeCursor(data []byte) (*cursorInfo, error) {
+	if len(data) < 2 {
+		return nil, errors.New("unable to decode cursor: not enough data")
+	}
 	flags := binary.LittleEndian.Uint16(data[:2])
 	if flags&1 == 1 {
 		// no cursor header ... ?
 		return nil, nil
 	}
 	// flags: 1=NONE, 2=CACHE_ME, 4=FROM_CACHE
+	if len(data) < 19 {
+		return nil, errors.New("unable to decode cursor: header too short")
+	}
 	info := &cursorInfo{}
 
 	info.unique = binary.LittleEndian.Uint64(data[2:10]) // unique cursor id, used for cache
@@ -146,27 +153,10 @@ func (d *ChCursor) decodeCursor(data []byte) (*cursorInfo, error) {
 
 	//l.Printf("spice/cursor: flags=%d unique=%d type=%d size=%d,%d hot=%d,%d rem=%d", flags, unique, typ, width, height, hotX, hotY, len(data))
 
-	switch info.typ {
-	case 0: // ALPHA
-		// len = 16408-5-17 = 16386. 64*64*4 = 16384
-		ln := int(info.width) * int(info.height) * 4
-		if len(data) < ln {
-			return nil, errors.New("unable to decode cursor: not enough data")
-		}
-
-		// reverse red & blue
-		for i := 0; i < len(data); i += 4 {
-			data[i], data[i+2] = data[i+2], data[i]
-		}
-
-		im := image.NewRGBA(image.Rectangle{Max: image.Point{int(info.width), int(info.height)}})
-		copy(im.Pix, data)
-
-		info.im = im
-
-		return info, nil
+	im, err := cursorImage(info.typ, info.width, info.height, data)
+	if err != nil {
+		return nil, err
 	}
-
-	// TODO
-	return nil, nil
+	info.im = im
+	return info, nil
 }
@@ -3,12 +3,12 @@
 package spice
 
 import (
-	"bytes"
 	"encoding/binary"
 	"image"
 	"image/color"
-	"image/draw"
 	"log"
+	"sync"
+	"time"
 )
 
 const (
@@ -93,61 +93,169 @@ const (
 type SpiceDisplay struct {
 	cl   *Client    // Reference to parent client
 	conn *SpiceConn // Connection to display channel
+	id   uint8      // Display channel id
 
-	display draw.Image // Current display image buffer
+	surfaces map[uint32]*surface // Surfaces by id
+	primary  *surface            // Surface shown on screen
+	marked   bool                // Initial surfaces were received
+
+	palettes map[uint64][]color.RGBA // Palettes cached with PAL_CACHE_ME
+	streams  map[uint32]*stream      // Video streams by id
+
+	damage      []image.Rectangle // Primary surface areas changed, not yet sent to the driver
+	damageTimer *time.Timer       // Pending delivery of damage, with WithDamageInterval
+
+	lk sync.Mutex // Held while handling messages and drawing stream frames
 }
 
 // setupDisplay establishes a connection to the display channel and initializes it
 // It advertises supported capabilities and compression preferences to the server
 func (cl *Client) setupDisplay(id uint8) (*SpiceDisplay, error) {
 	// Connect to display channel with specific capabilities
-	conn, err := cl.conn(ChannelDisplay, id, caps(
+	conn, err := cl.conn(ChannelDisplay, id, caps(append([]uint32{
 		SPICE_DISPLAY_CAP_SIZED_STREAM,     // Support sized stream messages
 		SPICE_DISPLAY_CAP_STREAM_REPORT,    // Support stream reporting
 		SPICE_DISPLAY_CAP_MONITORS_CONFIG,  // Support monitor configuration
 		SPICE_DISPLAY_CAP_LZ4_COMPRESSION,  // Support LZ4 compression
 		SPICE_DISPLAY_CAP_PREF_COMPRESSION, // Support setting preferred compression
-	))
+		SPICE_DISPLAY_CAP_COMPOSITE,        // Support DRAW_COMPOSITE
+	}, cl.codecCaps()...)...))
 	if err != nil {
 		return nil, err
 	}
 
 	// Create display handler and set message callback
-	m := &SpiceDisplay{cl: cl, conn: conn}
+	m := &SpiceDisplay{cl: cl, conn: conn, id: id}
 	conn.hndlr = m.handle
+	conn.onClose = m.close
+	if id == 0 {
+		cl.recLk.Lock()
+		cl.screen = m
+		cl.recLk.Unlock()
+	}
 
 	// Start message processing loop in background
 	go m.conn.ReadLoop()
 
 	// Enable image caching and global dictionary compression
-	// The 14 bytes are for cache parameters (all zeros = default values)
-	m.conn.WriteMessage(SPICE_MSGC_DISPLAY_INIT, make([]byte, 14))
+	// pixmap_cache_id, pixmap_cache_size, glz_dictionary_id, glz_dictionary_window_size
+	m.conn.WriteMessage(SPICE_MSGC_DISPLAY_INIT, uint8(displayPixmapCacheID), int64(displayPixmapCacheSize), uint8(displayGlzDictionaryID), int32(displayGlzWindowSize))
 
-	// Set LZ compression as preferred compression method
-	m.conn.WriteMessage(SPICE_MSGC_DISPLAY_PREFERRED_COMPRESSION, []byte{SPICE_IMAGE_COMPRESSION_AUTO_LZ})
+	// Set preferred compression method, GLZ unless configured otherwise
+	m.conn.WriteMessage(SPICE_MSGC_DISPLAY_PREFERRED_COMPRESSION, []byte{cl.compression})
 
-	// Set preferred video codecs (VP8 and MJPEG)
+	// Set preferred video codecs, only those we have a decoder for
 	// 1=MJPEG 2=VP8 3=H264 4=VP9 5=H265
-	m.conn.WriteMessage(SPICE_MSGC_DISPLAY_PREFERRED_VIDEO_CODEC_TYPE,
-		uint8(2), // Number of codecs
-		uint8(1), // MJPEG
-		uint8(2)) // VP8
+	codecs := cl.codecs()
+	pref := []byte{uint8(len(codecs))}
+	for _, c := range codecs {
+		pref = append(pref, c.typ)
+	}
+	m.conn.WriteMessage(SPICE_MSGC_DISPLAY_PREFERRED_VIDEO_CODEC_TYPE, pref)
 
 	return m, nil
 }
 
+// close stops the video streams and pending damage delivery once the
+// channel is closed
+func (d *SpiceDisplay) close() {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	d.destroyStreams()
+	d.resetDamage()
+}
+
 func (d *SpiceDisplay) handle(typ uint16, data []byte) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
 	switch typ {
 	case SPICE_MSG_DISPLAY_MARK:
 		log.Printf("spice/display: MARK!")
 
-		d.cl.driver.DisplayInit(d.display)
+		d.marked = true
+		if d.primary != nil {
+			d.resetDamage()
+			d.cl.displayInit(d.id, d.primary.img)
+		}
+	case SPICE_MSG_DISPLAY_INVAL_LIST:
+		// uint16 count, then resources: uint8 type, uint64 id
+		if len(data) < 2 {
+			return
+		}
+		cnt := int(binary.LittleEndian.Uint16(data[:2]))
+		if len(data) < 2+cnt*9 {
+			log.Printf("spice/display: inval list too short")
+			return
+		}
+		for i := 0; i < cnt; i++ {
+			res := data[2+i*9:]
+			if res[0] == SPICE_RES_TYPE_PIXMAP {
+				d.cl.pixmaps.remove(binary.LittleEndian.Uint64(res[1:9]))
+			}
+		}
+	case SPICE_MSG_DISPLAY_INVAL_ALL_PIXMAPS:
+		// the message lists channels to wait for before clearing, which only
+		// matters when several display channels share the cache, and those
+		// will request images again if needed
+		d.cl.pixmaps.clear()
+	case SPICE_MSG_DISPLAY_RESET:
+		// the server starts over with a new GLZ dictionary and palette cache
+		d.cl.glz.clear()
+		d.palettes = nil
+	case SPICE_MSG_DISPLAY_INVAL_PALETTE:
+		if len(data) < 8 {
+			return
+		}
+		delete(d.palettes, binary.LittleEndian.Uint64(data[:8]))
 	case SPICE_MSG_DISPLAY_INVAL_ALL_PALETTES:
-		log.Printf("spice/display: TODO invalidate all palettes")
+		d.palettes = nil
+	case SPICE_MSG_DISPLAY_COPY_BITS:
+		d.handleCopyBits(data)
 	case SPICE_MSG_DISPLAY_DRAW_FILL:
 		d.handleDrawFill(data)
+	case SPICE_MSG_DISPLAY_DRAW_OPAQUE:
+		d.handleDrawOpaque(data)
 	case SPICE_MSG_DISPLAY_DRAW_COPY:
 		d.handleDrawCopy(data)
+	case SPICE_MSG_DISPLAY_DRAW_BLEND:
+		d.handleDrawBlend(data)
+	case SPICE_MSG_DISPLAY_DRAW_BLACKNESS:
+		d.handleDrawFixed(data, SpiceRopdOpBlackness)
+	case SPICE_MSG_DISPLAY_DRAW_WHITENESS:
+		d.handleDrawFixed(data, SpiceRopdOpWhiteness)
+	case SPICE_MSG_DISPLAY_DRAW_INVERS:
+		d.handleDrawFixed(data, SpiceRopdOpInvers)
+	case SPICE_MSG_DISPLAY_DRAW_ROP3:
+		d.handleDrawRop3(data)
+	case SPICE_MSG_DISPLAY_DRAW_STROKE:
+		d.handleDrawStroke(data)
+	case SPICE_MSG_DISPLAY_DRAW_TEXT:
+		d.handleDrawText(data)
+	case SPICE_MSG_DISPLAY_DRAW_TRANSPARENT:
+		d.handleDrawTransparent(data)
+	case SPICE_MSG_DISPLAY_DRAW_ALPHA_BLEND:
+		d.handleDrawAlphaBlend(data)
+	case SPICE_MSG_DISPLAY_DRAW_COMPOSITE:
+		d.handleDrawComposite(data)
+	case SPICE_MSG_DISPLAY_STREAM_CREATE:
+		d.handleStreamCreate(data)
+	case SPICE_MSG_DISPLAY_STREAM_DATA:
+		d.handleStreamData(data, false)
+	case SPICE_MSG_DISPLAY_STREAM_DATA_SIZED:
+		d.handleStreamData(data, true)
+	case SPICE_MSG_DISPLAY_STREAM_CLIP:
+		d.handleStreamClip(data)
+	case SPICE_MSG_DISPLAY_STREAM_ACTIVATE_REPORT:
+		d.handleStreamActivateReport(data)
+	case SPICE_MSG_DISPLAY_STREAM_DESTROY:
+		if len(data) < 4 {
+			log.Printf("spice/display: stream destroy packet too short")
+			return
+		}
+		d.destroyStream(binary.LittleEndian.Uint32(data[:4]))
+	case SPICE_MSG_DISPLAY_STREAM_DESTROY_ALL:
+		d.destroyStreams()
 	case SPICE_MSG_DISPLAY_SURFACE_CREATE:
 		if len(data) < 20 {
 			log.Printf("spice/display: surface create packet too short")
@@ -162,159 +270,26 @@ func (d *SpiceDisplay) handle(typ uint16, data []byte) {
 		d.initSurface(sid, width, height, fmt, flags)
 		log.Printf("spice/display: surface create, id=%d %dx%d fmt=%d flags=%d", sid, width, height, fmt, flags)
 	case SPICE_MSG_DISPLAY_SURFACE_DESTROY:
-		// we don't really care but...
-		log.Printf("spice/display: TODO surface destroy")
-	case SPICE_MSG_DISPLAY_MONITORS_CONFIG:
 		if len(data) < 4 {
-			// too small
+			log.Printf("spice/display: surface destroy packet too short")
 			return
 		}
-		cnt := int(binary.LittleEndian.Uint16(data[:2]))
-		max := binary.LittleEndian.Uint16(data[2:4])
-
-		if len(data) < 4+(cnt*28) {
-			// too small
+		sid := binary.LittleEndian.Uint32(data[:4])
+		d.destroySurface(sid)
+		log.Printf("spice/display: surface destroy, id=%d", sid)
+	case SPICE_MSG_DISPLAY_MONITORS_CONFIG:
+		mons, err := parseMonitorsConfig(d.id, data)
+		if err != nil {
+			log.Printf("%s", err)
 			return
 		}
 
-		log.Printf("spice/display: SPICE_MSG_DISPLAY_MONITORS_CONFIG has %d/%d heads", cnt, max)
-		for i := 0; i < cnt; i++ {
-			info := data[4+(i*28) : 4+((i+1)*28)]
-			monitorId := binary.LittleEndian.Uint32(info[:4])
-			surfaceId := binary.LittleEndian.Uint32(info[4:8])
-			width := binary.LittleEndian.Uint32(info[8:12])
-			height := binary.LittleEndian.Uint32(info[12:16])
-			x := binary.LittleEndian.Uint32(info[16:20])
-			y := binary.LittleEndian.Uint32(info[20:24])
-			flags := binary.LittleEndian.Uint32(info[24:28])
-
-			log.Printf("spice/display: found monitor #%d (surface %d): %dx%d pos=%d,%d flags=%d", monitorId, surfaceId, width, height, x, y, flags)
+		log.Printf("spice/display: SPICE_MSG_DISPLAY_MONITORS_CONFIG has %d heads", len(mons))
+		for _, mon := range mons {
+			log.Printf("spice/display: found monitor #%d (surface %d): %dx%d pos=%d,%d flags=%d", mon.ID, mon.Surface, mon.Width, mon.Height, mon.X, mon.Y, mon.Flags)
 		}
+		d.cl.setMonitors(d.id, mons)
 	default:
 		log.Printf("spice/display: got message type=%d", typ)
 	}
 }
-
-func (d *SpiceDisplay) initSurface(sid, width, height, fmt, flags uint32) {
-	switch fmt {
-	case 1: // 1_A
-		log.Printf("todo")
-	case 8: // 8_A
-		log.Printf("todo")
-	case 16: // 16_555
-		log.Printf("todo")
-	case 80: // 16_565
-		log.Printf("todo")
-	case 32, 96: // 32_xRGB, 32_ARGB
-		img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
-		for p := range img.Pix {
-			if p%4 == 3 {
-				img.Pix[p] = 0xff
-			} else {
-				img.Pix[p] = 0
-			}
-		}
-
-		d.display = img
-	}
-}
-
-func (d *SpiceDisplay) handleDrawFill(req []byte) {
-	// DisplayBase, Brush brush, ropd, QMask
-
-	//log.Printf("spice/display: draw fill data len=%d", len(req))
-	r := bytes.NewReader(req)
-	// display_base: uint32 surface_id Rect box (x,y,w,h) Clip clip (clip_type type int8 none|rects, if rects → uint32 num_rects, rects[num_rects])
-	base := &DisplayBase{}
-	err := base.Decode(r)
-	if err != nil {
-		log.Printf("failed to decode display base: %s", err)
-		return
-	}
-
-	// brush_type enum8 → 0=NONE 1=SOLID 2=PATTERN
-	var brushType uint8
-	var brushColor uint32
-	binary.Read(r, binary.LittleEndian, &brushType)
-
-	switch brushType {
-	case 0: // NONE
-		// nothing
-		// ...
-		return
-	case 1: // SOLID
-		binary.Read(r, binary.LittleEndian, &brushColor)
-	case 2: // PATTERN
-		log.Printf("spice/display: pattern draw_fill not implemented")
-		return
-	}
-
-	// ropd rop_descriptor
-	var ropd Ropd
-	binary.Read(r, binary.LittleEndian, &ropd)
-
-	// QMask mask @outvar(mask)
-	var qmask QMask
-	qmask.Decode(r)
-
-	if qmask.ImagePtr != 0 {
-		qmask.Image, _ = DecodeImage(req[qmask.ImagePtr:])
-	}
-
-	// Apply COLOR
-	color := color.RGBA{uint8(brushColor), uint8(brushColor >> 8), uint8(brushColor >> 16), uint8(brushColor >> 24)}
-	b := base.Box.Rectangle()
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			d.display.Set(x, y, color)
-		}
-	}
-	d.cl.driver.DisplayRefresh()
-}
-
-func (d *SpiceDisplay) handleDrawCopy(req []byte) {
-	//log.Printf("spice/display: draw copy data len=%d", len(req))
-	r := bytes.NewReader(req)
-	// display_base: uint32 surface_id Rect box (x,y,w,h) Clip clip (clip_type type int8 none|rects, if rects → uint32 num_rects, rects[num_rects])
-	base := &DisplayBase{}
-	err := base.Decode(r)
-	if err != nil {
-		log.Printf("failed to decode display base: %s", err)
-		return
-	}
-	//log.Printf("display base = %+v", base)
-
-	var imgPtr uint32
-	binary.Read(r, binary.LittleEndian, &imgPtr)
-
-	// Rect src_area
-	srcArea := &Rect{}
-	srcArea.Decode(r)
-
-	// ropd rop_descriptor
-	var ropd Ropd
-	binary.Read(r, binary.LittleEndian, &ropd)
-
-	// image_scale_mode scale_mode
-	var scaleMode ImageScaleMode
-	binary.Read(r, binary.LittleEndian, &scaleMode)
-
-	// QMask mask @outvar(mask)
-	var qmask QMask
-	qmask.Decode(r)
-
-	if qmask.ImagePtr != 0 {
-		qmask.Image, _ = DecodeImage(req[qmask.ImagePtr:])
-	}
-
-	// decode image
-	img, err := DecodeImage(req[imgPtr:])
-	if err != nil {
-		log.Printf("failed to decode image: %s", err)
-		return
-	}
-
-	// put image on d.display, then refresh canvas
-	draw.Draw(d.display, base.Box.Rectangle(), img.Image, image.Point{0, 0}, draw.Over)
-	d.cl.driver.DisplayRefresh()
-}
@@ -92,8 +92,12 @@ func (input *ChInputs) OnKeyUp(k []byte) {
 }
 
 func (input *ChInputs) MousePosition(x, y uint32) {
-	var displayID uint8
+	input.MousePositionOn(0, x, y)
+}
 
+// MousePositionOn sends the mouse position relative to the given display, for
+// drivers implementing MonitorDriver
+func (input *ChInputs) MousePositionOn(displayID uint8, x, y uint32) {
 	err := input.conn.WriteMessage(SPICE_MSGC_INPUTS_MOUSE_POSITION, x, y, input.btn, displayID)
 	if err != nil {
 		log.Printf("Failed to send mouse position: %s", err)
@@ -42,6 +42,10 @@ const (
 	SPICE_MSGC_MAIN_AGENT_DATA  = 107
 	SPICE_MSGC_MAIN_AGENT_TOKEN = 108
 
+	SPICE_MSGC_MAIN_MIGRATE_END                = 109
+	SPICE_MSGC_MAIN_MIGRATE_DST_DO_SEAMLESS    = 110
+	SPICE_MSGC_MAIN_MIGRATE_CONNECTED_SEAMLESS = 111
+
 	VD_AGENT_PROTOCOL = 1
 )
 
@@ -148,10 +152,11 @@ type ClipboardData struct {
 }
 
 type ChMain struct {
-	cl    *Client
-	conn  *SpiceConn
-	ready chan struct{}
-	rOnce sync.Once
+	cl     *Client
+	conn   *SpiceConn
+	ready  chan struct{}
+	rOnce  sync.Once
+	closed chan struct{} // closed when the connection is lost
 
 	mouseModes   uint32 // available mouse modes mask
 	mouseMode    uint32
@@ -168,6 +173,7 @@ type ChMain struct {
 	vdl sync.Mutex
 	vdc *sync.Cond
 	vdb []byte // read buffer
+	vdx bool   // set when the channel is closed, stops the queue
 
 	// clipboard (remote→local)
 	clipboardCh chan *ClipboardData
@@ -175,23 +181,42 @@ type ChMain struct {
 }
 
 func (cl *Client) setupMain() error {
-	m := &ChMain{cl: cl, ready: make(chan struct{}), serverTokens: VD_AGENT_SERVER_TOKEN_AMOUNT}
+	m := &ChMain{cl: cl, ready: make(chan struct{}), closed: make(chan struct{}), serverTokens: VD_AGENT_SERVER_TOKEN_AMOUNT}
 
 	// establish connection to main channel
-	conn, err := cl.conn(ChannelMain, 0, caps(SPICE_MAIN_CAP_AGENT_CONNECTED_TOKENS))
+	conn, err := cl.conn(ChannelMain, 0, caps(SPICE_MAIN_CAP_AGENT_CONNECTED_TOKENS, SPICE_MAIN_CAP_SEMI_SEAMLESS_MIGRATE, SPICE_MAIN_CAP_SEAMLESS_MIGRATE))
 	if err != nil {
 		return err
 	}
 
 	m.conn = conn
+	m.vdc = sync.NewCond(&m.vdl)
 	conn.hndlr = m.handle
+	conn.onClose = m.close
 	cl.main = m
 	cl.driver.SetMainTarget(m)
 	go m.conn.ReadLoop()
 	go m.vdQueue()
 
-	<-m.ready
-	return nil
+	select {
+	case <-m.ready:
+		return nil
+	case <-m.closed:
+		return errors.New("spice: main channel closed during setup")
+	case <-cl.ctx.Done():
+		return cl.Err()
+	}
+}
+
+// close stops the agent queue
+func (m *ChMain) close() {
+	m.vdl.Lock()
+	defer m.vdl.Unlock()
+
+	m.vdx = true
+	m.vdq = nil
+	m.vdc.Broadcast()
+	close(m.closed)
 }
 
 func (m *ChMain) handle(typ uint16, data []byte) {
@@ -201,11 +226,11 @@ func (m *ChMain) handle(typ uint16, data []byte) {
 	case SPICE_MSG_MAIN_INIT:
 		// this is a initial msg sent from main
 
-		var agentTokens, mmTime uint32
+		var session, agentTokens, mmTime uint32
 		now := time.Now()
 
 		buf := bytes.NewReader(data)
-		binary.Read(buf, binary.LittleEndian, &m.cl.session)
+		binary.Read(buf, binary.LittleEndian, &session)
 		binary.Read(buf, binary.LittleEndian, &m.cl.displays)
 		binary.Read(buf, binary.LittleEndian, &m.mouseModes)
 		binary.Read(buf, binary.LittleEndian, &m.mouseMode)
@@ -214,19 +239,17 @@ func (m *ChMain) handle(typ uint16, data []byte) {
 		binary.Read(buf, binary.LittleEndian, &mmTime)
 		binary.Read(buf, binary.LittleEndian, &m.ramHint)
 
+		m.cl.setSession(session)
 		atomic.StoreUint32(&m.agentTokens, agentTokens)
 
-		log.Printf("spice/main: got MAIN_INIT: sessionID=%d displays=%d mouseModes=%d mouseMode=%d agent=%d agentTokens=%d mmTime=%d ramHint=%d", m.cl.session, m.cl.displays, m.mouseModes, m.mouseMode, m.agent, m.agentTokens, mmTime, m.ramHint)
+		log.Printf("spice/main: got MAIN_INIT: sessionID=%d displays=%d mouseModes=%d mouseMode=%d agent=%d agentTokens=%d mmTime=%d ramHint=%d", session, m.cl.displays, m.mouseModes, m.mouseMode, m.agent, m.agentTokens, mmTime, m.ramHint)
 
 		m.cl.mmLock.Lock()
 		m.cl.mmTime = mmTime
 		m.cl.mmStamp = now
 		m.cl.mmLock.Unlock()
 
-		if m.mouseModes&SPICE_MOUSE_MODE_CLIENT == SPICE_MOUSE_MODE_CLIENT && m.mouseMode != SPICE_MOUSE_MODE_CLIENT {
-			// set mouse mode to client
-			m.MouseModeRequest(SPICE_MOUSE_MODE_CLIENT)
-		}
+		m.restoreMouseMode()
 
 		// send SPICE_MSGC_MAIN_ATTACH_CHANNELS to receive channels list
 		m.conn.WriteMessage(SPICE_MSGC_MAIN_ATTACH_CHANNELS)
@@ -235,6 +258,7 @@ func (m *ChMain) handle(typ uint16, data []byte) {
 
 		if m.agent != 0 {
 			m.agentInit()
+			m.cl.emit(AgentConnected{})
 		}
 
 	case SPICE_MSG_MAIN_CHANNELS_LIST:
@@ -268,12 +292,10 @@ func (m *ChMain) handle(typ uint16, data []byte) {
 		m.mouseMode = uint32(current)
 		m.mouseModes = uint32(supported)
 
-		if m.mouseModes&SPICE_MOUSE_MODE_CLIENT == SPICE_MOUSE_MODE_CLIENT && m.mouseMode != SPICE_MOUSE_MODE_CLIENT {
-			// set mouse mode to client
-			m.MouseModeRequest(SPICE_MOUSE_MODE_CLIENT)
-		}
+		m.restoreMouseMode()
 
 		log.Printf("spice/main: mouse mode set to %d out of %d", current, supported)
+		m.cl.emit(MouseModeChanged{Mode: uint32(current), Supported: uint32(supported)})
 	case SPICE_MSG_MAIN_MULTI_MEDIA_TIME:
 		if len(data) != 4 {
 			return
@@ -288,8 +310,10 @@ func (m *ChMain) handle(typ uint16, data []byte) {
 	case SPICE_MSG_MAIN_AGENT_CONNECTED:
 		m.agent = 1
 		m.agentInit()
+		m.cl.emit(AgentConnected{})
 	case SPICE_MSG_MAIN_AGENT_DISCONNECTED:
 		m.agent = 0
+		m.cl.emit(AgentDisconnected{})
 	case SPICE_MSG_MAIN_AGENT_DATA:
 		m.agentHandler(data)
 	case SPICE_MSG_MAIN_AGENT_TOKEN:
@@ -297,6 +321,34 @@ func (m *ChMain) handle(typ uint16, data []byte) {
 			return
 		}
 		m.updateAgentToken(binary.LittleEndian.Uint32(data[:4]))
+	case SPICE_MSG_MAIN_MIGRATE_BEGIN, SPICE_MSG_MAIN_MIGRATE_BEGIN_SEAMLESS:
+		dst, err := parseMigrationTarget(data)
+		if err != nil {
+			log.Printf("spice/main: invalid migration request: %s", err)
+			m.conn.WriteMessage(SPICE_MSGC_MAIN_MIGRATE_CONNECT_ERROR)
+			return
+		}
+		seamless := typ == SPICE_MSG_MAIN_MIGRATE_BEGIN_SEAMLESS
+		var srcVersion uint32
+		if seamless && len(data) >= 24 {
+			srcVersion = binary.LittleEndian.Uint32(data[20:24])
+		}
+		log.Printf("spice/main: migration to %s requested (seamless=%v)", dst, seamless)
+		// connecting to the target takes time, do not block the main channel
+		go m.cl.migrateBegin(dst, seamless, srcVersion)
+	case SPICE_MSG_MAIN_MIGRATE_CANCEL:
+		log.Printf("spice/main: migration cancelled")
+		m.cl.migrateCancel()
+	case SPICE_MSG_MAIN_MIGRATE_END:
+		m.cl.migrateEnd()
+	case SPICE_MSG_MAIN_MIGRATE_SWITCH_HOST:
+		dst, err := parseMigrationTarget(data)
+		if err != nil {
+			log.Printf("spice/main: invalid switch host request: %s", err)
+			return
+		}
+		log.Printf("spice/main: server requested switching to %s", dst)
+		go m.cl.switchHost(dst)
 	default:
 		log.Printf("spice/main: got message type=%d", typ)
 	}
@@ -304,10 +356,33 @@ func (m *ChMain) handle(typ uint16, data []byte) {
 
 func (m *ChMain) updateAgentToken(amount uint32) {
 	atomic.AddUint32(&m.agentTokens, amount)
+	m.vdl.Lock()
 	m.vdc.Signal()
+	m.vdl.Unlock()
+}
+
+// restoreMouseMode requests the mouse mode wanted by the client (client mode
+// unless MouseModeRequest was called) if it is available and not current
+func (m *ChMain) restoreMouseMode() {
+	m.cl.stateLk.Lock()
+	want := m.cl.mouseMode
+	m.cl.stateLk.Unlock()
+
+	if m.mouseModes&want == want && m.mouseMode != want {
+		m.sendMouseMode(want)
+	}
 }
 
 func (m *ChMain) MouseModeRequest(mod uint32) error {
+	// remember the mode so it can be restored after reconnection
+	m.cl.stateLk.Lock()
+	m.cl.mouseMode = mod
+	m.cl.stateLk.Unlock()
+
+	return m.sendMouseMode(mod)
+}
+
+func (m *ChMain) sendMouseMode(mod uint32) error {
 	// mode value
 	// note: client mode is likely the best :)
 	buf := make([]byte, 4)
@@ -322,7 +397,7 @@ func (m *ChMain) agentInit() error {
 	m.conn.WriteMessage(SPICE_MSGC_MAIN_AGENT_START, uint32(VD_AGENT_SERVER_TOKEN_AMOUNT))
 
 	// send agent announce caps
-	return m.AgentWrite(
+	err := m.AgentWrite(
 		VD_AGENT_ANNOUNCE_CAPABILITIES,
 		uint32(1),
 		caps(
@@ -334,9 +409,32 @@ func (m *ChMain) agentInit() error {
 			VD_AGENT_CAP_CLIPBOARD_GRAB_SERIAL,
 		),
 	)
+	if err != nil {
+		return err
+	}
+
+	// restore the monitor configuration, in case we are reconnecting
+	m.cl.stateLk.Lock()
+	flags, mons := m.cl.monitorFlags, m.cl.monitors
+	m.cl.stateLk.Unlock()
+
+	if mons == nil {
+		return nil
+	}
+	return m.sendMonitorConfig(flags, mons)
 }
 
 func (m *ChMain) MonitorConfig(flags uint32, mons []SpiceMonitor) error {
+	// remember the configuration so it can be restored after reconnection
+	m.cl.stateLk.Lock()
+	m.cl.monitorFlags = flags
+	m.cl.monitors = append([]SpiceMonitor(nil), mons...)
+	m.cl.stateLk.Unlock()
+
+	return m.sendMonitorConfig(flags, mons)
+}
+
+func (m *ChMain) sendMonitorConfig(flags uint32, mons []SpiceMonitor) error {
 	return m.AgentWrite(
 		VD_AGENT_MONITORS_CONFIG,
 		uint32(len(mons)),
@@ -599,10 +697,14 @@ func (m *ChMain) agentHandler(data []byte) {
 }
 
 func (m *ChMain) vdQueue() {
-	m.vdc = sync.NewCond(&m.vdl)
 	m.vdl.Lock()
+	defer m.vdl.Unlock()
 
 	for {
+		if m.vdx {
+			return
+		}
+
 		if len(m.vdq) == 0 {
 			m.vdc.Wait()
 			continue
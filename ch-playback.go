@@ -52,6 +52,7 @@ func (cl *Client) setupPlayback(id uint8) (*ChPlayback, error) {
 	}
 	m := &ChPlayback{cl: cl, conn: conn, mute: false}
 	conn.hndlr = m.handle
+	conn.onClose = m.close
 
 	go m.conn.ReadLoop()
 
@@ -69,24 +70,23 @@ func (d *ChPlayback) handle(typ uint16, data []byte) {
 		if len(data) < 4 {
 			return
 		}
-		if d.stream == nil {
-			// audio output is not ready
-			return
-		}
 		tim := binary.LittleEndian.Uint32(data[:4])
 		data = data[4:]
+		var pcm []int16
 		switch d.mode {
 		case SPICE_AUDIO_DATA_MODE_RAW:
-			buf := make([]int16, len(data)/2)
-			for i := 0; i < len(buf); i++ {
-				buf[i] = int16(binary.LittleEndian.Uint16(data[i*2 : i*2+2]))
+			pcm = make([]int16, len(data)/2)
+			for i := 0; i < len(pcm); i++ {
+				pcm[i] = int16(binary.LittleEndian.Uint16(data[i*2 : i*2+2]))
 			}
-			d.w.Append(tim, buf)
 		case SPICE_AUDIO_DATA_MODE_OPUS:
+			if d.dec == nil {
+				return
+			}
 			// decode data
 			// it looks like we are always getting 10ms audio data at a time, but I don't know if that's reliable
 			frameSize := d.channels * 10 * d.freq / 1000
-			pcm := make([]int16, int(frameSize))
+			pcm = make([]int16, int(frameSize))
 			n, err := d.dec.Decode(data, pcm)
 			if err != nil {
 				log.Printf("spice/playback: failed to decode Opus data: %s", err)
@@ -94,9 +94,19 @@ func (d *ChPlayback) handle(typ uint16, data []byte) {
 			}
 
 			pcm = pcm[:n*int(d.channels)]
-			// send
-			d.w.Append(tim, pcm)
+		default:
+			return
+		}
+
+		if rec := d.cl.recording(0); rec != nil {
+			rec.audio(tim, int(d.channels), int(d.freq), pcm)
 		}
+		if d.stream == nil {
+			// audio output is not ready
+			return
+		}
+		// send
+		d.w.Append(tim, pcm)
 	case SPICE_MSG_PLAYBACK_MODE:
 		// initialize mode
 		// 00000000  05 2b 30 82 03 00                                 |.+0...|
@@ -120,7 +130,7 @@ func (d *ChPlayback) handle(typ uint16, data []byte) {
 
 		log.Printf("spice/playback: audio start channels=%d format=%d freq=%d time=%d", channels, format, freq, tim)
 
-		if channels == d.channels && format == d.format && freq == d.freq {
+		if channels == d.channels && format == d.format && freq == d.freq && d.stream != nil {
 			// no change
 			return
 		}
@@ -130,37 +140,34 @@ func (d *ChPlayback) handle(typ uint16, data []byte) {
 			return
 		}
 
-		if d.stream != nil {
-			d.stream.Abort()
-			d.stream.Close()
-			d.stream = nil
-		}
-
-		d.buf = make([]int16, 10*channels*freq/1000) // 48000kHz 2channels = 10*2*48000/1000 = 480
-		stream, err := portaudio.OpenDefaultStream(0, int(channels), float64(freq), len(d.buf)/int(channels), &d.buf)
-		if err != nil {
-			log.Printf("spice/playback: failed to initialize output: %s", err)
-			return
-		}
-
-		d.stream = stream
+		d.close()
 
 		// store info
 		d.channels = channels
 		d.format = format
 		d.freq = freq
-		d.w = NewTimeBuffer(d.cl, d)
-
-		d.stream.Start()
 
 		switch d.mode {
 		case SPICE_AUDIO_DATA_MODE_OPUS:
-			// initialize decoder
+			// initialize decoder, also needed for recording without audio output
+			var err error
 			d.dec, err = opus.NewDecoder(int(d.freq), int(d.channels))
 			if err != nil {
 				log.Printf("spice/playback: failed to initializa opus decoder: %s", err)
 			}
 		}
+
+		d.buf = make([]int16, 10*channels*freq/1000) // 48000kHz 2channels = 10*2*48000/1000 = 480
+		stream, err := portaudio.OpenDefaultStream(0, int(channels), float64(freq), len(d.buf)/int(channels), &d.buf)
+		if err != nil {
+			log.Printf("spice/playback: failed to initialize output: %s", err)
+			return
+		}
+
+		d.stream = stream
+		d.w = NewTimeBuffer(d.cl, d)
+
+		d.stream.Start()
 	case SPICE_MSG_PLAYBACK_STOP:
 		// don't care
 	case SPICE_MSG_PLAYBACK_VOLUME:
@@ -189,3 +196,16 @@ func (d *ChPlayback) handle(typ uint16, data []byte) {
 		log.Printf("spice/playback: got message type=%d", typ)
 	}
 }
+
+// close stops the audio output
+func (d *ChPlayback) close() {
+	if d.w != nil {
+		d.w.Close()
+		d.w = nil
+	}
+	if d.stream != nil {
+		d.stream.Abort()
+		d.stream.Close()
+		d.stream = nil
+	}
+}
@@ -25,6 +25,7 @@ type ChRecord struct {
 	pcm      []int16           // PCM buffer for audio data (16-bit signed)
 	enc      *opus.Encoder     // Opus encoder for audio compression
 	run      uint32            // Atomic flag to control recording state
+	done     chan struct{}     // Closed when the recording goroutine returns
 }
 
 const (
@@ -57,6 +58,7 @@ func (cl *Client) setupRecord(id uint8) (*ChRecord, error) {
 	// Create record handler and set message callback
 	m := &ChRecord{cl: cl, conn: conn}
 	conn.hndlr = m.handle
+	conn.onClose = m.close
 
 	// Select audio encoding mode based on negotiated capabilities
 	switch {
@@ -104,11 +106,7 @@ func (d *ChRecord) handle(typ uint16, data []byte) {
 		}
 
 		// Clean up existing audio stream if any
-		if d.stream != nil {
-			d.stream.Abort()
-			d.stream.Close()
-			d.stream = nil
-		}
+		d.close()
 
 		// Create PCM buffer (10ms of audio data)
 		d.pcm = make([]int16, 10*channels*freq/1000) // e.g., 48000Hz, 2channels = 10*2*48000/1000 = 960 samples
@@ -143,6 +141,7 @@ func (d *ChRecord) handle(typ uint16, data []byte) {
 		}
 
 		// Start background goroutine for capturing and sending audio data
+		d.done = make(chan struct{})
 		go d.startRecord()
 
 	case SPICE_MSG_RECORD_STOP:
@@ -184,6 +183,7 @@ func (d *ChRecord) handle(typ uint16, data []byte) {
 // startRecord continually captures audio data from the microphone,
 // encodes it, and sends it to the SPICE server
 func (d *ChRecord) startRecord() {
+	defer close(d.done)
 	defer d.stream.Stop()
 
 	// Allocate buffer for encoded audio data
@@ -217,3 +217,18 @@ func (d *ChRecord) startRecord() {
 		}
 	}
 }
+
+// close stops recording and releases the audio input stream
+func (d *ChRecord) close() {
+	atomic.StoreUint32(&d.run, 0)
+	if d.done != nil {
+		// wait for the recording goroutine to stop using the stream
+		<-d.done
+		d.done = nil
+	}
+	if d.stream != nil {
+		d.stream.Abort()
+		d.stream.Close()
+		d.stream = nil
+	}
+}
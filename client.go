@@ -3,6 +3,9 @@
 package spice
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"image"
 	"log"
 	"net"
@@ -21,7 +24,8 @@ type Connector interface {
 type Driver interface {
 	// DisplayInit initializes the display with the given image
 	DisplayInit(image.Image)
-	// DisplayRefresh triggers a refresh of the display
+	// DisplayRefresh triggers a refresh of the display, see DamageDriver to
+	// only refresh the areas changed
 	DisplayRefresh()
 	// SetEventsTarget sets the input events channel for sending user input
 	SetEventsTarget(*ChInputs)
@@ -45,105 +49,396 @@ type Client struct {
 	c        Connector   // Network connection provider
 	driver   Driver      // Implementation for handling display/input
 	password string      // Password for SPICE authentication
-	session  uint32      // SPICE connection ID
+	session  uint32      // SPICE connection ID, protected by connsLk
 	displays uint32      // Number of displays available
 	Debug    *log.Logger // Optional logger for debug information
 
+	sasl []SASLMechanism // SASL mechanisms, in order of preference
+
 	// Channel handlers for different SPICE channels
 	main     *ChMain      // Main channel for connection management
 	playback *ChPlayback  // Audio playback channel
 	record   *ChRecord    // Audio recording channel
 	webdav   *SpiceWebdav // WebDAV channel for file transfers
 
+	pixmaps *imageCache // Image cache shared by display channels
+	glz     *glzWindow  // GLZ dictionary shared by display channels
+
+	compression uint8        // preferred image compression
+	videoCodecs []videoCodec // video codecs registered with WithVideoDecoder
+
+	damageInterval time.Duration // batching of display damage, 0 to deliver it after each draw
+
+	// Recording
+	recLk    sync.Mutex
+	recorder *Recorder     // nil if not recording
+	screen   *SpiceDisplay // display channel 0, recorded
+
 	// Media time synchronization
 	mmTime  uint32       // Media time in milliseconds from server
 	mmStamp time.Time    // Local timestamp when mmTime was received
 	mmLock  sync.RWMutex // Lock for media time access
+
+	// Session lifecycle
+	ctx       context.Context
+	cancel    context.CancelFunc
+	conns     map[*SpiceConn]struct{} // Active channel connections
+	connsLk   sync.Mutex
+	loops     sync.WaitGroup // Running read loops
+	done      chan struct{}  // Closed once the session has fully stopped
+	err       error          // Reason the session ended
+	closeOnce sync.Once
+
+	// Session events
+	events       chan Event
+	eventsLk     sync.Mutex
+	eventsClosed bool
+
+	// Migration
+	migration *migration // in progress migration, if any
+	migLk     sync.Mutex
+
+	// Reconnection
+	reconnect  *ReconnectPolicy // nil if reconnection is disabled
+	connecting bool             // main channel (re)connection in progress
+	gen        uint32           // incremented each time the main channel is reconnected
+
+	// State restored after reconnection
+	stateLk      sync.Mutex
+	mouseMode    uint32         // mouse mode requested by the client
+	monitors     []SpiceMonitor // last monitor configuration sent to the agent
+	monitorFlags uint32
+	heads        map[uint8][]DisplayMonitor // monitors reported by each display channel
+}
+
+// Option configures optional features of a Client
+type Option func(*Client)
+
+// WithSASL enables SASL authentication using the given mechanisms, in order
+// of preference. SASL is used when the server requires it (QEMU's sasl=on).
+func WithSASL(mechs ...SASLMechanism) Option {
+	return func(cl *Client) {
+		cl.sasl = append(cl.sasl, mechs...)
+	}
+}
+
+// WithImageCompression sets the image compression the display channels ask
+// the server to use, one of SPICE_IMAGE_COMPRESSION_*. The default is
+// SPICE_IMAGE_COMPRESSION_AUTO_GLZ. SPICE_IMAGE_COMPRESSION_LZ4 is the
+// cheapest on fast networks.
+func WithImageCompression(c uint8) Option {
+	return func(cl *Client) {
+		cl.compression = c
+	}
 }
 
 // New creates a new SPICE client and establishes connection to all available channels
 // It requires a Connector for network access, a Driver for GUI interaction,
 // and the password for SPICE authentication
-func New(c Connector, driver Driver, password string) (*Client, error) {
-	cl := &Client{c: c, driver: driver, password: password}
+func New(c Connector, driver Driver, password string, opts ...Option) (*Client, error) {
+	return NewWithContext(context.Background(), c, driver, password, opts...)
+}
+
+// NewWithContext creates a new SPICE client like New. The session is closed
+// when ctx is cancelled, in which case Err will return ctx.Err().
+func NewWithContext(ctx context.Context, c Connector, driver Driver, password string, opts ...Option) (*Client, error) {
+	cl := &Client{
+		c:           c,
+		driver:      driver,
+		password:    password,
+		conns:       make(map[*SpiceConn]struct{}),
+		done:        make(chan struct{}),
+		events:      make(chan Event, eventsBuffer),
+		pixmaps:     newImageCache(displayPixmapCacheSize),
+		glz:         newGlzWindow(displayGlzWindowSize),
+		compression: SPICE_IMAGE_COMPRESSION_AUTO_GLZ,
+		connecting:  true,
+		mouseMode:   SPICE_MOUSE_MODE_CLIENT,
+	}
+	for _, opt := range opts {
+		opt(cl)
+	}
+	cl.ctx, cl.cancel = context.WithCancel(ctx)
+
+	go func() {
+		<-cl.ctx.Done()
+		// no-op if the session was already shut down
+		cl.shutdown(ctx.Err())
+	}()
 
 	// First establish the main channel connection
 	err := cl.setupMain()
 	if err != nil {
+		cl.shutdown(err)
 		return nil, err
 	}
 
 	// Connect to all available channels in parallel
+	cl.setupChannels()
+
+	cl.connsLk.Lock()
+	cl.connecting = false
+	cl.connsLk.Unlock()
+
+	if err := cl.Err(); err != nil {
+		// session ended during setup
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+// setupChannels connects to all channels announced by the main channel
+func (client *Client) setupChannels() {
 	var wg sync.WaitGroup
-	for _, ch := range cl.main.channels {
-		switch ch.typ {
-		case ChannelDisplay:
-			if ch.id > 0 {
-				// TODO handle multiple screens
-				continue
-			}
-			wg.Add(1)
-			go func(id uint8) {
-				defer wg.Done()
-				cl.setupDisplay(id)
-			}(ch.id)
-		case ChannelInputs:
-			wg.Add(1)
-			go func(id uint8) {
-				defer wg.Done()
-				cl.setupInputs(id)
-			}(ch.id)
-		case ChannelCursor:
-			if ch.id > 0 {
-				// TODO handle multiple screens
-				continue
+	for _, ch := range client.main.channels {
+		wg.Add(1)
+		go func(ch SpiceChannelInfo) {
+			defer wg.Done()
+			if err := client.setupChannel(ch); err != nil {
+				log.Printf("spice: could not connect to channel %s[%d]: %s", ch.typ, ch.id, err)
+				client.emit(ChannelFailed{Channel: ch.typ, ID: ch.id, Err: err})
 			}
-			wg.Add(1)
-			go func(id uint8) {
-				defer wg.Done()
-				cl.setupCursor(id)
-			}(ch.id)
-		case ChannelPlayback:
-			wg.Add(1)
-			go func(id uint8) {
-				defer wg.Done()
-				cl.playback, _ = cl.setupPlayback(id)
-			}(ch.id)
-		case ChannelRecord:
-			wg.Add(1)
-			go func(id uint8) {
-				defer wg.Done()
-				cl.record, _ = cl.setupRecord(id)
-			}(ch.id)
-		case ChannelWebdav:
-			wg.Add(1)
-			go func(id uint8) {
-				defer wg.Done()
-				cl.webdav, _ = cl.setupWebdav(id)
-			}(ch.id)
-		case ChannelUsbRedir:
-			log.Printf("spice: USB supported, device #%d", ch.id)
-			// Do nothing - USB support is not yet implemented
-		default:
-			log.Printf("spice: could not connect to channel %s[%d]: unknown type", ch.typ, ch.id)
-		}
+		}(ch)
 	}
 	wg.Wait()
+}
 
-	return cl, nil
+// setupChannel connects to a single channel
+func (client *Client) setupChannel(ch SpiceChannelInfo) error {
+	switch ch.typ {
+	case ChannelDisplay:
+		if _, ok := client.multiMonitor(); !ok && ch.id > 0 {
+			// driver only handles a single display
+			return nil
+		}
+		_, err := client.setupDisplay(ch.id)
+		return err
+	case ChannelInputs:
+		_, err := client.setupInputs(ch.id)
+		return err
+	case ChannelCursor:
+		if _, ok := client.multiMonitor(); !ok && ch.id > 0 {
+			// driver only handles a single display
+			return nil
+		}
+		_, err := client.setupCursor(ch.id)
+		return err
+	case ChannelPlayback:
+		p, err := client.setupPlayback(ch.id)
+		if err != nil {
+			return err
+		}
+		client.playback = p
+	case ChannelRecord:
+		r, err := client.setupRecord(ch.id)
+		if err != nil {
+			return err
+		}
+		client.record = r
+	case ChannelWebdav:
+		w, err := client.setupWebdav(ch.id)
+		if err != nil {
+			return err
+		}
+		client.webdav = w
+	case ChannelUsbRedir:
+		log.Printf("spice: USB supported, device #%d", ch.id)
+		// Do nothing - USB support is not yet implemented
+	default:
+		return errors.New("unknown type")
+	}
+	return nil
+}
+
+// Close ends the session, closing all channel connections and stopping audio
+// streams. It does not wait for the channels to stop, use Done for that.
+func (client *Client) Close() error {
+	client.shutdown(ErrClosed)
+	return nil
+}
+
+// Done returns a channel that is closed once the session has ended and all
+// of its channels have stopped
+func (client *Client) Done() <-chan struct{} {
+	return client.done
+}
+
+// Err returns nil while the session is running, and the reason it ended
+// afterward: ErrClosed if Close was called, the context's error if it was
+// cancelled, or the error that caused the main channel to fail
+func (client *Client) Err() error {
+	client.connsLk.Lock()
+	defer client.connsLk.Unlock()
+
+	return client.err
+}
+
+func (client *Client) shutdown(err error) {
+	client.closeOnce.Do(func() {
+		client.connsLk.Lock()
+		client.err = err
+		conns := client.conns
+		client.conns = nil
+		client.connsLk.Unlock()
+
+		client.cancel()
+
+		// closing connections causes the read loops to exit and run their
+		// channel specific cleanup
+		for c := range conns {
+			c.Close()
+		}
+
+		go func() {
+			client.loops.Wait()
+			close(client.done)
+			client.closeEvents()
+		}()
+	})
+}
+
+// sessionID returns the id of the current session, 0 until the server
+// assigned one
+func (client *Client) sessionID() uint32 {
+	client.connsLk.Lock()
+	defer client.connsLk.Unlock()
+	return client.session
+}
+
+// setSession sets the id of the current session, read by channels while
+// linking
+func (client *Client) setSession(id uint32) {
+	client.connsLk.Lock()
+	defer client.connsLk.Unlock()
+	client.session = id
+}
+
+// trackConn registers a newly linked connection, which is expected to run its
+// ReadLoop right away
+func (client *Client) trackConn(c *SpiceConn) error {
+	client.connsLk.Lock()
+	defer client.connsLk.Unlock()
+
+	if client.conns == nil {
+		return ErrClosed
+	}
+	c.gen = client.gen
+	client.conns[c] = struct{}{}
+	client.loops.Add(1)
+	return nil
+}
+
+// connDone is called by ReadLoop once it exits
+func (client *Client) connDone(c *SpiceConn, err error) {
+	defer client.loops.Done()
+
+	client.connsLk.Lock()
+	_, active := client.conns[c]
+	delete(client.conns, c)
+	connecting := client.connecting
+	client.connsLk.Unlock()
+
+	c.Close()
+	if c.onClose != nil {
+		c.onClose()
+	}
+
+	if !active {
+		// session is shutting down or reconnecting, error is expected
+		return
+	}
+
+	log.Printf("spice: %s read failed: %s", c.String(), err)
+	client.emit(ChannelLost{Channel: c.typ, ID: c.id, Err: err})
+
+	switch {
+	case connecting && c.typ == ChannelMain:
+		// main channel setup will report the failure
+	case client.reconnect == nil:
+		if c.typ == ChannelMain {
+			client.shutdown(fmt.Errorf("spice: main channel lost: %w", err))
+		}
+	case c.typ == ChannelMain:
+		go client.reconnectSession(err)
+	default:
+		go client.reconnectChannel(SpiceChannelInfo{typ: c.typ, id: c.id}, c.gen)
+	}
+}
+
+// connector returns the Connector for the current server, which changes
+// after a migration
+func (client *Client) connector() Connector {
+	client.connsLk.Lock()
+	defer client.connsLk.Unlock()
+
+	return client.c
+}
+
+func (client *Client) setConnector(c Connector) {
+	client.connsLk.Lock()
+	defer client.connsLk.Unlock()
+
+	client.c = c
 }
 
 func (client *Client) conn(typ Channel, chId uint8, channelCaps []uint32) (*SpiceConn, error) {
+	conn, err := client.dial(client.connector(), typ, chId, channelCaps)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.trackConn(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.emit(ChannelConnected{Channel: typ, ID: chId, Secure: conn.secure})
+	return conn, nil
+}
+
+// dial links a channel using the given connector, following its secure or
+// plain text policy
+func (client *Client) dial(c Connector, typ Channel, chId uint8, channelCaps []uint32) (*SpiceConn, error) {
+	mode := ChannelModeInsecure
+	sc, hasSecure := c.(SecureConnector)
+	if hasSecure {
+		mode = sc.SpiceChannelMode(typ)
+	}
+
+	conn, err := client.link(c, typ, chId, channelCaps, mode == ChannelModeSecure)
+	if err == nil || mode != ChannelModeAny {
+		return conn, err
+	}
+
+	// server may require a different kind of connection for this channel
+	switch {
+	case errors.Is(err, ErrSpiceLinkNeedSecured):
+		log.Printf("spice: channel %s[%d] requires TLS, retrying", typ, chId)
+		return client.link(c, typ, chId, channelCaps, true)
+	case errors.Is(err, ErrSpiceLinkNeedUnsecured):
+		log.Printf("spice: channel %s[%d] requires plain text, retrying", typ, chId)
+		return client.link(c, typ, chId, channelCaps, false)
+	}
+	return nil, err
+}
+
+func (client *Client) link(c Connector, typ Channel, chId uint8, channelCaps []uint32, secure bool) (*SpiceConn, error) {
 	compress := false
 	if typ == ChannelDisplay {
 		// we want to compress that
 		compress = true
 	}
-	cnx, err := client.c.SpiceConnect(compress)
+
+	var cnx net.Conn
+	var err error
+	if secure {
+		cnx, err = c.(SecureConnector).SpiceConnectSecure(compress)
+	} else {
+		cnx, err = c.SpiceConnect(compress)
+	}
 	if err != nil {
 		return nil, err
 	}
-	conn := &SpiceConn{client: client, conn: cnx}
+	conn := &SpiceConn{client: client, conn: cnx, secure: secure}
 
 	if err := conn.handshake(typ, chId, channelCaps); err != nil {
 		conn.Close()
@@ -170,10 +465,9 @@ func (client *Client) MediaTill(t uint32) time.Duration {
 	return time.Until(client.mmStamp.Add(tOfft))
 }
 
+// UpdateView asks the guest to use a single monitor of the given size
 func (client *Client) UpdateView(w, h int) {
-	if m := client.main; m != nil {
-		m.MonitorConfig(0, []SpiceMonitor{SpiceMonitor{Width: uint32(w), Height: uint32(h), Depth: 32}})
-	}
+	client.UpdateViews([]SpiceMonitor{SpiceMonitor{Width: uint32(w), Height: uint32(h), Depth: 32}})
 }
 
 func (client *Client) ToggleMute() {
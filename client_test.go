@@ -0,0 +1,294 @@
+package spice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testDriver is a Driver doing nothing
+type testDriver struct{}
+
+func (testDriver) DisplayInit(image.Image)                {}
+func (testDriver) DisplayRefresh()                        {}
+func (testDriver) SetEventsTarget(*ChInputs)              {}
+func (testDriver) SetMainTarget(*ChMain)                  {}
+func (testDriver) SetCursor(img image.Image, x, y uint16) {}
+func (testDriver) ClipboardGrabbed(selection SpiceClipboardSelection, clipboardTypes []SpiceClipboardFormat) {
+}
+func (testDriver) ClipboardFetch(selection SpiceClipboardSelection, clType SpiceClipboardFormat) ([]byte, error) {
+	return nil, nil
+}
+func (testDriver) ClipboardRelease(selection SpiceClipboardSelection) {}
+
+// testServer is a minimal SPICE server only providing a main channel
+type testServer struct {
+	key *rsa.PrivateKey
+
+	lk    sync.Mutex
+	conns []net.Conn
+	links int      // number of main channel links
+	recv  []uint16 // types of the messages received
+
+	next *testServer // migration target
+}
+
+func newTestServer(t *testing.T) *testServer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{key: key}
+}
+
+func (s *testServer) SpiceConnect(compress bool) (net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	srv, err := l.Accept()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	s.lk.Lock()
+	s.conns = append(s.conns, srv)
+	s.lk.Unlock()
+	go s.serve(srv)
+	return c, nil
+}
+
+func (s *testServer) SpiceMigrate(dst MigrationTarget) (Connector, error) {
+	if s.next == nil {
+		return nil, errors.New("no migration target")
+	}
+	return s.next, nil
+}
+
+// send writes a message on the first connection
+func (s *testServer) send(typ uint16, data []byte) {
+	s.lk.Lock()
+	c := s.conns[0]
+	s.lk.Unlock()
+	s.write(c, typ, data)
+}
+
+// waitRecv waits until a message of the given type has been received
+func (s *testServer) waitRecv(t *testing.T, typ uint16) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.lk.Lock()
+		for _, v := range s.recv {
+			if v == typ {
+				s.lk.Unlock()
+				return
+			}
+		}
+		s.lk.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("message %d not received", typ)
+}
+
+// dropAll closes all server side connections, as if the server went away
+func (s *testServer) dropAll() {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) write(c net.Conn, typ uint16, data []byte) {
+	hdr := make([]byte, 6)
+	binary.LittleEndian.PutUint16(hdr[:2], typ)
+	binary.LittleEndian.PutUint32(hdr[2:], uint32(len(data)))
+	c.Write(append(hdr, data...))
+}
+
+func (s *testServer) serve(c net.Conn) {
+	defer c.Close()
+
+	// SpiceLinkMess
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(hdr[12:]))
+	if _, err := io.ReadFull(c, body); err != nil {
+		return
+	}
+	if Channel(body[4]) == ChannelMain {
+		s.lk.Lock()
+		s.links++
+		s.lk.Unlock()
+	}
+
+	// SpiceLinkReply
+	pub, _ := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	reply := &bytes.Buffer{}
+	binary.Write(reply, binary.LittleEndian, uint32(ErrSpiceLinkOk))
+	reply.Write(pub)
+	binary.Write(reply, binary.LittleEndian, []uint32{1, 0, 4 + uint32(len(pub)) + 12})
+	binary.Write(reply, binary.LittleEndian, caps(SPICE_COMMON_CAP_PROTOCOL_AUTH_SELECTION, SPICE_COMMON_CAP_AUTH_SPICE, SPICE_COMMON_CAP_MINI_HEADER))
+	c.Write([]byte(SPICE_MAGIC))
+	binary.Write(c, binary.LittleEndian, []uint32{SPICE_VERSION_MAJOR, SPICE_VERSION_MINOR, uint32(reply.Len())})
+	c.Write(reply.Bytes())
+
+	// auth mechanism + ticket
+	buf := make([]byte, 4+128)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return
+	}
+	binary.Write(c, binary.LittleEndian, uint32(ErrSpiceLinkOk))
+
+	// MAIN_INIT: session, displays, mouse modes, mouse mode, agent, agent tokens, mm time, ram hint
+	init := &bytes.Buffer{}
+	binary.Write(init, binary.LittleEndian, []uint32{42, 1, SPICE_MOUSE_MODE_SERVER | SPICE_MOUSE_MODE_CLIENT, SPICE_MOUSE_MODE_CLIENT, 0, 0, 1000, 0})
+	s.write(c, SPICE_MSG_MAIN_INIT, init.Bytes())
+
+	for {
+		var typ uint16
+		var size uint32
+		if err := binary.Read(c, binary.LittleEndian, &typ); err != nil {
+			return
+		}
+		if err := binary.Read(c, binary.LittleEndian, &size); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(c, make([]byte, size)); err != nil {
+			return
+		}
+		s.lk.Lock()
+		s.recv = append(s.recv, typ)
+		s.lk.Unlock()
+		if typ == SPICE_MSGC_MAIN_ATTACH_CHANNELS {
+			// no other channel
+			s.write(c, SPICE_MSG_MAIN_CHANNELS_LIST, make([]byte, 4))
+		}
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	srv := newTestServer(t)
+
+	cl, err := New(srv, testDriver{}, "password")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, uint32(42), cl.sessionID())
+	assert.Nil(t, cl.Err())
+
+	cl.Close()
+
+	select {
+	case <-cl.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not stop")
+	}
+	assert.Equal(t, ErrClosed, cl.Err())
+}
+
+func TestClientMainLost(t *testing.T) {
+	srv := newTestServer(t)
+
+	cl, err := New(srv, testDriver{}, "password")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	srv.dropAll()
+
+	select {
+	case <-cl.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not stop")
+	}
+	assert.NotNil(t, cl.Err())
+	assert.NotEqual(t, ErrClosed, cl.Err())
+}
+
+func TestClientReconnect(t *testing.T) {
+	srv := newTestServer(t)
+
+	cl, err := New(srv, testDriver{}, "password", WithReconnect(ReconnectPolicy{InitialBackoff: 10 * time.Millisecond}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer cl.Close()
+
+	srv.dropAll()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.lk.Lock()
+		links, conns := srv.links, len(srv.conns)
+		srv.lk.Unlock()
+		if links == 2 && conns == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("main channel was not re-linked (links=%d)", links)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Nil(t, cl.Err())
+	select {
+	case <-cl.Done():
+		t.Fatal("session stopped")
+	default:
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	srv := newTestServer(t)
+
+	cl, err := New(srv, testDriver{}, "password")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ev := <-cl.Events()
+	assert.Equal(t, ChannelConnected{Channel: ChannelMain, ID: 0}, ev)
+
+	srv.dropAll()
+
+	var lost bool
+	timeout := time.After(5 * time.Second)
+	for !lost {
+		select {
+		case ev, ok := <-cl.Events():
+			if !ok {
+				t.Fatal("events channel closed before ChannelLost")
+			}
+			_, lost = ev.(ChannelLost)
+		case <-timeout:
+			t.Fatal("no ChannelLost event")
+		}
+	}
+
+	// channel is closed once the session has ended
+	for range cl.Events() {
+	}
+	assert.NotNil(t, cl.Err())
+}
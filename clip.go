@@ -0,0 +1,206 @@
+package spice
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+)
+
+const SPICE_MASK_FLAGS_INVERS = 1
+
+// drawArea is the part of a surface a draw operation may change: its box,
+// restricted by the clip rectangles and the mask
+type drawArea struct {
+	box    image.Rectangle
+	clip   []image.Rectangle // nil if not clipped
+	mask   image.Image       // nil if no mask
+	maskAt image.Point       // mask position of the top left of the box
+	invers bool              // mask is inverted
+	opaque bool              // surface has no alpha channel
+}
+
+// target returns the surface a draw operation applies to and the area it
+// may change, or a nil surface if it does not exist
+func (d *SpiceDisplay) target(base *DisplayBase, mask *QMask) (*image.RGBA, *drawArea) {
+	s, ok := d.surfaces[base.Surface]
+	if !ok {
+		d.surface(base.Surface) // logs
+		return nil, nil
+	}
+
+	a := &drawArea{
+		box:    base.Box.Rectangle().Intersect(s.img.Rect),
+		opaque: s.format != SPICE_SURFACE_FMT_32_ARGB && s.format != SPICE_SURFACE_FMT_8_A && s.format != SPICE_SURFACE_FMT_1_A,
+	}
+	if base.ClipType == 1 {
+		a.clip = make([]image.Rectangle, 0, len(base.Rects))
+		for _, r := range base.Rects {
+			if c := r.Rectangle().Intersect(a.box); !c.Empty() {
+				a.clip = append(a.clip, c)
+			}
+		}
+	}
+	if mask != nil && mask.Image != nil {
+		a.mask = mask.Image.Image
+		a.maskAt = image.Pt(int(mask.Pos.X), int(mask.Pos.Y))
+		a.invers = mask.MaskFlags&SPICE_MASK_FLAGS_INVERS != 0
+	}
+	return s.img, a
+}
+
+// contains returns true if the pixel at x, y may be drawn
+func (a *drawArea) contains(x, y int) bool {
+	p := image.Pt(x, y)
+	if !p.In(a.box) {
+		return false
+	}
+	if a.clip != nil {
+		var in bool
+		for _, r := range a.clip {
+			if p.In(r) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	if a.mask != nil {
+		m := rgbaAt(a.mask, a.maskAt.X+x-a.box.Min.X, a.maskAt.Y+y-a.box.Min.Y)
+		set := m.R|m.G|m.B != 0
+		if set == a.invers {
+			return false
+		}
+	}
+	return true
+}
+
+// rects returns the rectangles of the area, ignoring the mask
+func (a *drawArea) rects() []image.Rectangle {
+	if a.clip != nil {
+		return a.clip
+	}
+	return []image.Rectangle{a.box}
+}
+
+// each calls fn for each pixel of dst in the area, with x and y relative to
+// the box
+func (a *drawArea) each(dst *image.RGBA, fn func(x, y int, p []byte)) {
+	a.eachIn(dst, a.box, fn)
+}
+
+// eachIn calls fn for each pixel of dst in both r and the area, with x and y
+// relative to r
+func (a *drawArea) eachIn(dst *image.RGBA, r image.Rectangle, fn func(x, y int, p []byte)) {
+	for _, c := range a.rects() {
+		c = c.Intersect(r).Intersect(dst.Rect)
+		for y := c.Min.Y; y < c.Max.Y; y++ {
+			for x := c.Min.X; x < c.Max.X; x++ {
+				if a.mask != nil && !a.contains(x, y) {
+					continue
+				}
+				o := dst.PixOffset(x, y)
+				p := dst.Pix[o : o+4 : o+4]
+				fn(x-r.Min.X, y-r.Min.Y, p)
+				if a.opaque {
+					p[3] = 0xff
+				}
+			}
+		}
+	}
+}
+
+// opaqueRect sets the alpha of the pixels of r to 0xff
+func opaqueRect(dst *image.RGBA, r image.Rectangle) {
+	r = r.Intersect(dst.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := dst.Pix[dst.PixOffset(r.Min.X, y):dst.PixOffset(r.Max.X, y)]
+		for i := 3; i < len(row); i += 4 {
+			row[i] = 0xff
+		}
+	}
+}
+
+// decodeMaskImage decodes the image of a QMask. Masks are usually 1 bit
+// bitmaps without palette, set bits being drawn.
+func (d *SpiceDisplay) decodeMaskImage(msg []byte, ptr uint32) (*Image, error) {
+	if ptr == 0 || uint64(ptr)+18+18 > uint64(len(msg)) {
+		return d.decodeImage(msg, ptr)
+	}
+	buf := msg[ptr:]
+	format := BitmapImageType(buf[18])
+	if buf[8] != SPICE_IMAGE_TYPE_BITMAP || (format != BITMAP_IMAGE_TYPE_1BIT_LE && format != BITMAP_IMAGE_TYPE_1BIT_BE) {
+		return d.decodeImage(msg, ptr)
+	}
+
+	i := &Image{
+		ID:     binary.LittleEndian.Uint64(buf[:8]),
+		Type:   buf[8],
+		Flags:  buf[9],
+		Width:  binary.LittleEndian.Uint32(buf[10:14]),
+		Height: binary.LittleEndian.Uint32(buf[14:18]),
+	}
+	// same layout as a 1 bit palette bitmap, with a black and white palette
+	img, err := bitmapImage(buf[18:], []color.RGBA{{}, {0xff, 0xff, 0xff, 0xff}})
+	if err != nil {
+		return nil, err
+	}
+	i.Image = img
+	if i.Flags&(SPICE_IMAGE_FLAGS_CACHE_ME|SPICE_IMAGE_FLAGS_CACHE_REPLACE_ME) != 0 {
+		d.cl.pixmaps.put(i.ID, i, false)
+	}
+	return i, nil
+}
+
+// scaledSource returns the pixels of area of img stretched to a box of the
+// given size, for positions relative to the box
+func scaledSource(img image.Image, area image.Rectangle, size image.Point, mode ImageScaleMode) func(x, y int) color.RGBA {
+	if area.Dx() == size.X && area.Dy() == size.Y || area.Empty() || size.X <= 0 || size.Y <= 0 {
+		return func(x, y int) color.RGBA {
+			return rgbaAt(img, area.Min.X+x, area.Min.Y+y)
+		}
+	}
+
+	sx := float64(area.Dx()) / float64(size.X)
+	sy := float64(area.Dy()) / float64(size.Y)
+	if mode == ImageScaleModeNearest {
+		return func(x, y int) color.RGBA {
+			return rgbaAt(img, area.Min.X+int((float64(x)+0.5)*sx), area.Min.Y+int((float64(y)+0.5)*sy))
+		}
+	}
+
+	clamp := func(v, min, max int) int {
+		if v < min {
+			return min
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	return func(x, y int) color.RGBA {
+		// bilinear interpolation of the 4 nearest pixels
+		fx := float64(area.Min.X) + (float64(x)+0.5)*sx - 0.5
+		fy := float64(area.Min.Y) + (float64(y)+0.5)*sy - 0.5
+		x0, y0 := math.Floor(fx), math.Floor(fy)
+		wx, wy := fx-x0, fy-y0
+		ix0, iy0 := clamp(int(x0), area.Min.X, area.Max.X), clamp(int(y0), area.Min.Y, area.Max.Y)
+		ix1, iy1 := clamp(int(x0)+1, area.Min.X, area.Max.X), clamp(int(y0)+1, area.Min.Y, area.Max.Y)
+
+		c00, c10 := rgbaAt(img, ix0, iy0), rgbaAt(img, ix1, iy0)
+		c01, c11 := rgbaAt(img, ix0, iy1), rgbaAt(img, ix1, iy1)
+		mix := func(a, b, c, d uint8) uint8 {
+			top := float64(a)*(1-wx) + float64(b)*wx
+			bottom := float64(c)*(1-wx) + float64(d)*wx
+			return uint8(top*(1-wy) + bottom*wy + 0.5)
+		}
+		return color.RGBA{
+			R: mix(c00.R, c10.R, c01.R, c11.R),
+			G: mix(c00.G, c10.G, c01.G, c11.G),
+			B: mix(c00.B, c10.B, c01.B, c11.B),
+			A: mix(c00.A, c10.A, c01.A, c11.A),
+		}
+	}
+}
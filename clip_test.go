@@ -0,0 +1,73 @@
+package spice
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrawClipRects(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 4, 4, true)
+
+	// only the top left pixel and the bottom row are in the clip region
+	m := (&testMsg{}).put(uint32(0), Rect{Top: 0, Left: 0, Bottom: 4, Right: 4}, uint8(1), uint32(2))
+	m.put(Rect{Top: 0, Left: 0, Bottom: 1, Right: 1}, Rect{Top: 3, Left: 0, Bottom: 4, Right: 4})
+	m.put(uint8(SPICE_BRUSH_TYPE_SOLID), uint32(0xffffff), SpiceRopdOpPut, uint8(0), Point{}, uint32(0))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_FILL, m.Bytes())
+
+	white, black := color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0, 0, 0, 0xff}
+	img := d.surfaces[0].img
+	assert.Equal(t, white, img.RGBAAt(0, 0))
+	assert.Equal(t, black, img.RGBAAt(1, 0))
+	assert.Equal(t, black, img.RGBAAt(2, 2))
+	assert.Equal(t, white, img.RGBAAt(3, 3))
+}
+
+func TestDrawMask(t *testing.T) {
+	for _, invers := range []bool{false, true} {
+		d := newTestDisplay()
+		d.createSurface(0, 4, 1, true)
+
+		// 1 bit mask 4x1: 1010, used from its second pixel
+		var flags uint8
+		if invers {
+			flags = SPICE_MASK_FLAGS_INVERS
+		}
+		m := (&testMsg{}).base(0, Rect{Top: 0, Left: 0, Bottom: 1, Right: 3})
+		maskPtr := uint32(m.Len() + 5 + 2 + 1 + 8 + 4)
+		m.put(uint8(SPICE_BRUSH_TYPE_SOLID), uint32(0xffffff), SpiceRopdOpPut, flags, Point{X: 1}, maskPtr)
+		m.put(uint64(0), uint8(SPICE_IMAGE_TYPE_BITMAP), uint8(0), uint32(4), uint32(1))
+		m.put(uint8(BITMAP_IMAGE_TYPE_1BIT_BE), uint8(SPICE_BITMAP_FLAGS_TOP_DOWN), uint32(4), uint32(1), uint32(1), uint32(0), uint8(0xa0))
+		d.handle(SPICE_MSG_DISPLAY_DRAW_FILL, m.Bytes())
+
+		img := d.surfaces[0].img
+		assert.Equal(t, !invers, img.RGBAAt(1, 0).R == 0xff, "invers=%v", invers)
+		assert.Equal(t, invers, img.RGBAAt(0, 0).R == 0xff, "invers=%v", invers)
+		assert.Equal(t, invers, img.RGBAAt(2, 0).R == 0xff, "invers=%v", invers)
+		assert.Equal(t, uint8(0), img.RGBAAt(3, 0).R, "invers=%v", invers)
+	}
+}
+
+func TestScaledSource(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	img.SetRGBA(1, 0, color.RGBA{0, 0, 0, 0xff})
+	img.SetRGBA(2, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	area := image.Rect(1, 0, 3, 1)
+
+	nearest := scaledSource(img, area, image.Pt(4, 1), ImageScaleModeNearest)
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, nearest(1, 0))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, nearest(2, 0))
+
+	// interpolation stays within the source area
+	smooth := scaledSource(img, area, image.Pt(4, 1), ImageScaleModeInterpolate)
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, smooth(0, 0))
+	assert.Equal(t, color.RGBA{0x40, 0x40, 0x40, 0xff}, smooth(1, 0))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, smooth(3, 0))
+
+	// same size, plain offset
+	same := scaledSource(img, area, image.Pt(2, 1), ImageScaleModeInterpolate)
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, same(1, 0))
+}
@@ -22,20 +22,25 @@ import (
 // It handles the protocol-level communication including message framing,
 // authentication, and capability negotiation
 type SpiceConn struct {
-	client *Client                       // Reference to the parent client
-	conn   net.Conn                      // Underlying network connection
-	serial uint64                        // Serial counter for outgoing messages
-	wLock  sync.Mutex                    // Lock for writing to conn
-	hndlr  func(typ uint16, data []byte) // Message handler callback
-	pub    *rsa.PublicKey                // Server's public key for authentication
-	typ    Channel                       // Channel type (main, display, inputs, etc.)
-	id     uint8                         // Channel ID
+	client  *Client                       // Reference to the parent client
+	conn    net.Conn                      // Underlying network connection, replaced on migration
+	connLk  sync.Mutex                    // Lock for replacing conn, in addition to wLock
+	serial  uint64                        // Serial counter for outgoing messages
+	wLock   sync.Mutex                    // Lock for writing to conn
+	hndlr   func(typ uint16, data []byte) // Message handler callback
+	onClose func()                        // Channel cleanup, called once ReadLoop exits
+	pub     *rsa.PublicKey                // Server's public key for authentication
+	typ     Channel                       // Channel type (main, display, inputs, etc.)
+	id      uint8                         // Channel ID
+	secure  bool                          // Whether conn is TLS protected
+	gen     uint32                        // Client session generation this conn belongs to
 
 	// Negotiated protocol version
 	major uint32 // Major version
 	minor uint32 // Minor version
 
 	// Capability negotiation
+	reqCaps     []uint32 // Channel-specific capabilities we requested
 	commonCaps  []uint32 // Common capabilities from server
 	channelCaps []uint32 // Channel-specific capabilities from server
 	validCaps   []uint32 // Negotiated capabilities (intersection)
@@ -54,6 +59,7 @@ type SpiceConn struct {
 func (c *SpiceConn) ReadLoop() {
 	// Read packets until an error occurs (typically connection closed)
 	for {
+		cnx, _ := c.current()
 		err := c.ReadData(func(typ uint16, data []byte) error {
 			// Handle acknowledgment according to the ack window
 			doAck := false
@@ -76,12 +82,51 @@ func (c *SpiceConn) ReadLoop() {
 			return c.process(typ, data)
 		})
 		if err != nil {
-			log.Printf("spice: read failed: %s", err)
+			if cur, _ := c.current(); cur != cnx {
+				// connection was switched to the migration target
+				continue
+			}
+			c.client.connDone(c, err)
 			return
 		}
 	}
 }
 
+// current returns the underlying connection and whether it uses mini headers
+func (c *SpiceConn) current() (net.Conn, bool) {
+	c.connLk.Lock()
+	defer c.connLk.Unlock()
+
+	return c.conn, c.miniHeaders
+}
+
+// switchTo replaces the underlying connection with the one of dst, linked to
+// the migration target, and closes the previous connection
+func (c *SpiceConn) switchTo(dst *SpiceConn) {
+	c.wLock.Lock()
+	c.connLk.Lock()
+	old := c.conn
+	c.conn = dst.conn
+	c.secure = dst.secure
+	c.pub = dst.pub
+	c.major, c.minor = dst.major, dst.minor
+	c.commonCaps, c.channelCaps, c.validCaps = dst.commonCaps, dst.channelCaps, dst.validCaps
+	c.miniHeaders = dst.miniHeaders
+	atomic.StoreUint64(&c.serial, atomic.LoadUint64(&dst.serial))
+	c.connLk.Unlock()
+	c.wLock.Unlock()
+
+	// the target may have sent SET_ACK already
+	dst.ackL.Lock()
+	ackW, ackP := dst.ackW, dst.ackP
+	dst.ackL.Unlock()
+	c.ackL.Lock()
+	c.ackW, c.ackP = ackW, ackP
+	c.ackL.Unlock()
+
+	old.Close()
+}
+
 func (c *SpiceConn) String() string {
 	return fmt.Sprintf("%s[%d]", c.typ.String(), c.id)
 }
@@ -133,11 +178,27 @@ func (c *SpiceConn) process(typ uint16, data []byte) error {
 		// what: error_code/warn_code/info_code
 
 		log.Printf("spice: %s says ts=%d severity=%d visibility=%d what=%d: %s", c.String(), ts, severity, visibility, what, msg)
+		c.client.emit(ServerNotify{
+			Channel:    c.typ,
+			Time:       ts,
+			Severity:   NotifySeverity(severity),
+			Visibility: NotifyVisibility(visibility),
+			What:       what,
+			Message:    string(msg),
+		})
+	case SPICE_MSG_MIGRATE:
+		if len(data) < 4 {
+			return nil
+		}
+		c.client.migrateChannel(c, binary.LittleEndian.Uint32(data[:4]))
+	case SPICE_MSG_MIGRATE_DATA:
+		c.client.migrateData(c, data)
 	case SPICE_MSG_WAIT_FOR_CHANNELS:
 		// TODO
 		log.Printf("spice: %s got SPICE_MSG_WAIT_FOR_CHANNELS, ignored", c.String())
 	case SPICE_MSG_DISCONNECTING:
 		log.Printf("spice: %s got SPICE_MSG_DISCONNECTING", c.String())
+		c.client.emit(ServerDisconnecting{Channel: c.typ, ID: c.id})
 	default:
 		if c.hndlr != nil {
 			c.hndlr(typ, data)
@@ -173,16 +234,17 @@ func (c *SpiceConn) ReadError() error {
 }
 
 func (c *SpiceConn) ReadData(cb func(typ uint16, data []byte) error) error {
+	cnx, miniHeaders := c.current()
 
-	if c.miniHeaders {
+	if miniHeaders {
 		// only type & size
 		var typ uint16
 		var size uint32
-		err := binary.Read(c.conn, binary.LittleEndian, &typ)
+		err := binary.Read(cnx, binary.LittleEndian, &typ)
 		if err != nil {
 			return err
 		}
-		err = binary.Read(c.conn, binary.LittleEndian, &size)
+		err = binary.Read(cnx, binary.LittleEndian, &size)
 		if err != nil {
 			return err
 		}
@@ -192,7 +254,7 @@ func (c *SpiceConn) ReadData(cb func(typ uint16, data []byte) error) error {
 		}
 
 		buf := make([]byte, size)
-		if err = c.ReadFull(buf); err != nil {
+		if _, err = io.ReadFull(cnx, buf); err != nil {
 			return err
 		}
 		return cb(typ, buf)
@@ -202,13 +264,13 @@ func (c *SpiceConn) ReadData(cb func(typ uint16, data []byte) error) error {
 	var typ uint16
 	var serial uint64
 
-	err := binary.Read(c.conn, binary.LittleEndian, &serial)
+	err := binary.Read(cnx, binary.LittleEndian, &serial)
 	if err != nil {
 		return err
 	}
-	binary.Read(c.conn, binary.LittleEndian, &typ)
-	binary.Read(c.conn, binary.LittleEndian, &size)
-	binary.Read(c.conn, binary.LittleEndian, &subList)
+	binary.Read(cnx, binary.LittleEndian, &typ)
+	binary.Read(cnx, binary.LittleEndian, &size)
+	binary.Read(cnx, binary.LittleEndian, &subList)
 
 	//log.Printf("spice: read data serial=%d type=%d size=%d subList=%d", d.Serial, d.Message.Type, size, subList)
 
@@ -217,7 +279,7 @@ func (c *SpiceConn) ReadData(cb func(typ uint16, data []byte) error) error {
 	}
 
 	buf := make([]byte, size)
-	if err := c.ReadFull(buf); err != nil {
+	if _, err := io.ReadFull(cnx, buf); err != nil {
 		return err
 	}
 
@@ -302,6 +364,7 @@ func (c *SpiceConn) WriteMessage(typ uint16, data ...interface{}) error {
 func (c *SpiceConn) handshake(typ Channel, chId uint8, channelCaps []uint32) error {
 	c.typ = typ
 	c.id = chId
+	c.reqCaps = channelCaps
 	err := c.sendSpiceLinkMess(typ, chId, channelCaps)
 	if err != nil {
 		return err
@@ -324,7 +387,33 @@ func (c *SpiceConn) handshake(typ Channel, chId uint8, channelCaps []uint32) err
 	}
 	log.Printf("spice: %s channel req_caps=%v caps=%v valid_caps=%v", c.String(), channelCaps, c.channelCaps, c.validCaps)
 
-	// encrypt password
+	if !c.testCommonCap(SPICE_COMMON_CAP_PROTOCOL_AUTH_SELECTION) {
+		// legacy server, only spice ticket is available
+		return c.authSpice()
+	}
+
+	switch {
+	case c.testCommonCap(SPICE_COMMON_CAP_AUTH_SASL):
+		if len(c.client.sasl) == 0 {
+			return errors.New("spice: server requires SASL authentication but no mechanism was configured")
+		}
+		if err := binary.Write(c.conn, binary.LittleEndian, uint32(SPICE_COMMON_CAP_AUTH_SASL)); err != nil {
+			return err
+		}
+		return c.authSASL()
+	case c.testCommonCap(SPICE_COMMON_CAP_AUTH_SPICE):
+		if err := binary.Write(c.conn, binary.LittleEndian, uint32(SPICE_COMMON_CAP_AUTH_SPICE)); err != nil {
+			return err
+		}
+		return c.authSpice()
+	default:
+		return errors.New("spice: no supported authentication method")
+	}
+}
+
+// authSpice performs the spice ticket authentication, sending the password
+// encrypted with the server's public key
+func (c *SpiceConn) authSpice() error {
 	ciphertext, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, c.pub, []byte(c.client.password), nil)
 	if err != nil {
 		return err
@@ -334,13 +423,24 @@ func (c *SpiceConn) handshake(typ Channel, chId uint8, channelCaps []uint32) err
 	return c.ReadError()
 }
 
+func (c *SpiceConn) testCommonCap(cap uint32) bool {
+	n := int(cap / 32)
+	if n >= len(c.commonCaps) {
+		return false
+	}
+	return testCap(c.commonCaps[n], cap%32)
+}
+
 func (c *SpiceConn) sendSpiceLinkMess(typ Channel, chId uint8, channelCaps []uint32) error {
 	// generate a SpiceLinkMess packet and send
 	pkt := &bytes.Buffer{}
 
-	commonCaps := caps(SPICE_COMMON_CAP_MINI_HEADER)
+	commonCaps := caps(SPICE_COMMON_CAP_PROTOCOL_AUTH_SELECTION, SPICE_COMMON_CAP_AUTH_SPICE, SPICE_COMMON_CAP_MINI_HEADER)
+	if len(c.client.sasl) > 0 {
+		commonCaps[0] |= 1 << SPICE_COMMON_CAP_AUTH_SASL
+	}
 
-	binary.Write(pkt, binary.LittleEndian, c.client.session)
+	binary.Write(pkt, binary.LittleEndian, c.client.sessionID())
 	binary.Write(pkt, binary.LittleEndian, typ)
 	binary.Write(pkt, binary.LittleEndian, chId)
 	binary.Write(pkt, binary.LittleEndian, uint32(len(commonCaps)))  // num_common_caps
@@ -442,7 +542,7 @@ func (c *SpiceConn) readSpiceLinkReply() error {
 		c.channelCaps = append(c.channelCaps, v)
 	}
 
-	if len(c.commonCaps) > 0 && c.commonCaps[0]&(1<<SPICE_COMMON_CAP_MINI_HEADER) == (1<<SPICE_COMMON_CAP_MINI_HEADER) {
+	if c.testCommonCap(SPICE_COMMON_CAP_MINI_HEADER) {
 		c.miniHeaders = true
 	}
 
@@ -452,5 +552,6 @@ func (c *SpiceConn) readSpiceLinkReply() error {
 }
 
 func (c *SpiceConn) Close() error {
-	return c.conn.Close()
+	cnx, _ := c.current()
+	return cnx.Close()
 }
@@ -24,6 +24,10 @@ const (
 
 	SPICE_MSG_FIRST_AVAIL = 101
 
+	// SPICE_MSG_MIGRATE flags
+	SPICE_MIGRATE_NEED_FLUSH         = 1
+	SPICE_MIGRATE_NEED_DATA_TRANSFER = 2
+
 	//
 	SPICE_MSGC_ACK_SYNC           = 1
 	SPICE_MSGC_ACK                = 2
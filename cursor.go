@@ -0,0 +1,132 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// cursorImage decodes the pixels of a cursor, which follow its header.
+//
+// MONO cursors are an AND mask followed by a XOR mask, 1 bit per pixel. The
+// other color cursors are the pixels, a palette for COLOR4 and COLOR8, then
+// an AND mask. Pixels with the AND bit set are transparent, or invert the
+// screen if their XOR bit or color is set. Inverting can't be expressed
+// with an image, so such pixels are black, outlined in white to remain
+// visible on any background.
+func cursorImage(typ uint8, width, height uint16, data []byte) (*image.RGBA, error) {
+	w, h := int(width), int(height)
+	maskStride := (w + 7) / 8
+	maskLen := maskStride * h
+	bit := func(mask []byte, x, y int) bool {
+		return mask[y*maskStride+x/8]&(0x80>>(x%8)) != 0
+	}
+
+	switch typ {
+	case SPICE_CURSOR_TYPE_ALPHA:
+		if len(data) < w*h*4 {
+			return nil, errors.New("unable to decode cursor: not enough data")
+		}
+		im := image.NewRGBA(image.Rect(0, 0, w, h))
+		// BGRA, premultiplied like image.RGBA
+		for i := 0; i < w*h*4; i += 4 {
+			im.Pix[i], im.Pix[i+1], im.Pix[i+2], im.Pix[i+3] = data[i+2], data[i+1], data[i], data[i+3]
+		}
+		return im, nil
+	case SPICE_CURSOR_TYPE_MONO:
+		if len(data) < maskLen*2 {
+			return nil, errors.New("unable to decode cursor: not enough data")
+		}
+		and, xor := data[:maskLen], data[maskLen:maskLen*2]
+		return cursorPixels(w, h, func(x, y int) (uint32, bool, bool) {
+			if bit(xor, x, y) {
+				return 0xffffff, bit(and, x, y), true
+			}
+			return 0, bit(and, x, y), false
+		}), nil
+	}
+
+	var bits, palLen int
+	switch typ {
+	case SPICE_CURSOR_TYPE_COLOR4:
+		bits, palLen = 4, 16
+	case SPICE_CURSOR_TYPE_COLOR8:
+		bits, palLen = 8, 256
+	case SPICE_CURSOR_TYPE_COLOR16:
+		bits = 16
+	case SPICE_CURSOR_TYPE_COLOR24:
+		bits = 24
+	case SPICE_CURSOR_TYPE_COLOR32:
+		bits = 32
+	default:
+		return nil, fmt.Errorf("unable to decode cursor: unsupported type %d", typ)
+	}
+
+	stride := (w*bits + 7) / 8
+	if len(data) < stride*h+palLen*4+maskLen {
+		return nil, errors.New("unable to decode cursor: not enough data")
+	}
+	pix := data[:stride*h]
+	pal := data[stride*h : stride*h+palLen*4]
+	and := data[stride*h+palLen*4 : stride*h+palLen*4+maskLen]
+
+	return cursorPixels(w, h, func(x, y int) (uint32, bool, bool) {
+		row := pix[y*stride:]
+		var c uint32 // xRGB
+		switch typ {
+		case SPICE_CURSOR_TYPE_COLOR4:
+			idx := row[x/2] >> (4 * (1 - x%2)) & 0x0f
+			c = binary.LittleEndian.Uint32(pal[idx*4:])
+		case SPICE_CURSOR_TYPE_COLOR8:
+			c = binary.LittleEndian.Uint32(pal[int(row[x])*4:])
+		case SPICE_CURSOR_TYPE_COLOR16:
+			// x1r5g5b5
+			p := uint32(binary.LittleEndian.Uint16(row[x*2:]))
+			r, g, b := p>>10&0x1f, p>>5&0x1f, p&0x1f
+			c = (r<<3|r>>2)<<16 | (g<<3|g>>2)<<8 | (b<<3 | b>>2)
+		case SPICE_CURSOR_TYPE_COLOR24:
+			c = uint32(row[x*3+2])<<16 | uint32(row[x*3+1])<<8 | uint32(row[x*3])
+		case SPICE_CURSOR_TYPE_COLOR32:
+			c = binary.LittleEndian.Uint32(row[x*4:])
+		}
+		c &= 0xffffff
+		return c, bit(and, x, y), c != 0
+	}), nil
+}
+
+// cursorPixels builds a cursor image from a function returning for each
+// pixel its xRGB color, its AND bit, and whether its XOR part is set
+func cursorPixels(w, h int, pixel func(x, y int) (c uint32, and, xor bool)) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, w, h))
+	var inverted []image.Point
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c, and, xor := pixel(x, y)
+			p := im.Pix[im.PixOffset(x, y):]
+			switch {
+			case !and:
+				p[0], p[1], p[2], p[3] = uint8(c>>16), uint8(c>>8), uint8(c), 0xff
+			case xor:
+				// inverted, black for now
+				p[3] = 0xff
+				inverted = append(inverted, image.Pt(x, y))
+			}
+		}
+	}
+
+	// outline inverted pixels with white where the cursor is transparent
+	for _, pt := range inverted {
+		for _, n := range []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			q := pt.Add(n)
+			if !q.In(im.Rect) {
+				continue
+			}
+			p := im.Pix[im.PixOffset(q.X, q.Y):]
+			if p[3] == 0 {
+				p[0], p[1], p[2], p[3] = 0xff, 0xff, 0xff, 0xff
+			}
+		}
+	}
+	return im
+}
@@ -0,0 +1,82 @@
+package spice
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	cursorBlack = color.RGBA{0, 0, 0, 0xff}
+	cursorWhite = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+func TestCursorMono(t *testing.T) {
+	// 8x2: black, white, transparent, inverted, then transparent pixels
+	and := []byte{0x3f, 0xff}
+	xor := []byte{0x50, 0x00}
+	im, err := cursorImage(SPICE_CURSOR_TYPE_MONO, 8, 2, append(and, xor...))
+	assert.NoError(t, err)
+
+	assert.Equal(t, cursorBlack, im.RGBAAt(0, 0))
+	assert.Equal(t, cursorWhite, im.RGBAAt(1, 0))
+	assert.Equal(t, cursorBlack, im.RGBAAt(3, 0)) // inverted
+	// transparent pixels next to inverted ones are outlined
+	assert.Equal(t, cursorWhite, im.RGBAAt(2, 0))
+	assert.Equal(t, cursorWhite, im.RGBAAt(4, 0))
+	assert.Equal(t, cursorWhite, im.RGBAAt(3, 1))
+	assert.Equal(t, color.RGBA{}, im.RGBAAt(5, 0))
+	assert.Equal(t, color.RGBA{}, im.RGBAAt(2, 1))
+
+	_, err = cursorImage(SPICE_CURSOR_TYPE_MONO, 8, 2, and)
+	assert.Error(t, err)
+}
+
+func TestCursorColor(t *testing.T) {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	// 2x1 cursors, first pixel red, second blue but transparent
+	and := []byte{0x40}
+	pal := make([]byte, 256*4)
+	pal[4+2], pal[8] = 0xff, 0xff // 1=red 2=blue
+
+	tests := []struct {
+		typ  uint8
+		data []byte
+	}{
+		{SPICE_CURSOR_TYPE_COLOR4, append(append([]byte{0x12}, pal[:16*4]...), and...)},
+		{SPICE_CURSOR_TYPE_COLOR8, append(append([]byte{1, 2}, pal...), and...)},
+		{SPICE_CURSOR_TYPE_COLOR16, append([]byte{0x00, 0x7c, 0x1f, 0x00}, and...)},
+		{SPICE_CURSOR_TYPE_COLOR24, append([]byte{0, 0, 0xff, 0xff, 0, 0}, and...)},
+		{SPICE_CURSOR_TYPE_COLOR32, append([]byte{0, 0, 0xff, 0, 0xff, 0, 0, 0}, and...)},
+	}
+	for _, test := range tests {
+		im, err := cursorImage(test.typ, 2, 1, test.data)
+		assert.NoError(t, err, "type %d", test.typ)
+		assert.Equal(t, red, im.RGBAAt(0, 0), "type %d", test.typ)
+		// AND with a color inverts the screen
+		assert.Equal(t, cursorBlack, im.RGBAAt(1, 0), "type %d", test.typ)
+
+		_, err = cursorImage(test.typ, 2, 1, test.data[:len(test.data)-1])
+		assert.Error(t, err, "type %d", test.typ)
+	}
+
+	// AND without a color is transparent
+	im, err := cursorImage(SPICE_CURSOR_TYPE_COLOR32, 2, 1, append(make([]byte, 8), 0xc0))
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{}, im.RGBAAt(0, 0))
+}
+
+func TestDecodeCursor(t *testing.T) {
+	d := &ChCursor{}
+	// flags, unique, type, width, height, hot_x, hot_y, BGRA pixel
+	m := (&testMsg{}).put(uint16(0), uint64(1), uint8(SPICE_CURSOR_TYPE_ALPHA), uint16(1), uint16(1), uint16(0), uint16(0), []byte{1, 2, 3, 4})
+	cur, err := d.decodeCursor(m.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{3, 2, 1, 4}, cur.im.At(0, 0))
+
+	for _, n := range []int{0, 1, 10, len(m.Bytes()) - 1} {
+		_, err = d.decodeCursor(m.Bytes()[:n])
+		assert.Error(t, err, "%d bytes", n)
+	}
+}
@@ -0,0 +1,112 @@
+package spice
+
+import (
+	"image"
+	"time"
+)
+
+// damage rectangles kept before merging them into their bounding box
+const maxDamageRects = 32
+
+// DamageDriver is an optional interface for drivers able to update only the
+// parts of a display that changed. When the driver implements it,
+// DisplayDamage is called instead of DisplayRefresh and MonitorRefresh.
+type DamageDriver interface {
+	Driver
+
+	// DisplayDamage is called when rects of the image of a display were
+	// updated, in surface coordinates. The driver owns rects.
+	DisplayDamage(display uint8, rects []image.Rectangle)
+}
+
+// WithDamageInterval batches display updates: the rectangles changed are
+// accumulated and passed to the driver at most once per interval, instead
+// of after each draw command.
+func WithDamageInterval(t time.Duration) Option {
+	return func(cl *Client) {
+		cl.damageInterval = t
+	}
+}
+
+// addDamage records r as changed on the primary surface, and delivers it
+// now or once the damage interval elapsed
+func (d *SpiceDisplay) addDamage(rects []image.Rectangle) {
+	for _, r := range rects {
+		d.damage = mergeDamage(d.damage, r)
+	}
+	if len(d.damage) == 0 {
+		return
+	}
+
+	if d.cl.damageInterval <= 0 {
+		d.flushDamage()
+		return
+	}
+	if d.damageTimer == nil {
+		d.damageTimer = time.AfterFunc(d.cl.damageInterval, func() {
+			d.lk.Lock()
+			defer d.lk.Unlock()
+			d.damageTimer = nil
+			d.flushDamage()
+		})
+	}
+}
+
+// flushDamage delivers the damage accumulated to the driver
+func (d *SpiceDisplay) flushDamage() {
+	rects := d.damage
+	d.damage = nil
+	if len(rects) == 0 {
+		return
+	}
+	if rec := d.cl.recording(d.id); rec != nil {
+		rec.damage(rects)
+	}
+
+	if dd, ok := d.cl.driver.(DamageDriver); ok {
+		if _, multi := d.cl.multiMonitor(); multi || d.id == 0 {
+			dd.DisplayDamage(d.id, rects)
+		}
+		return
+	}
+	d.cl.displayRefresh(d.id)
+}
+
+// resetDamage drops the damage accumulated, as when the whole display is
+// refreshed
+func (d *SpiceDisplay) resetDamage() {
+	d.damage = nil
+	if d.damageTimer != nil {
+		d.damageTimer.Stop()
+		d.damageTimer = nil
+	}
+}
+
+// mergeDamage adds r to damage, skipping it if already covered and merging
+// the rectangles into their bounding box once there are too many
+func mergeDamage(damage []image.Rectangle, r image.Rectangle) []image.Rectangle {
+	if r.Empty() {
+		return damage
+	}
+	for _, c := range damage {
+		if r.In(c) {
+			return damage
+		}
+	}
+	res := damage[:0]
+	for _, c := range damage {
+		if !c.In(r) {
+			res = append(res, c)
+		}
+	}
+	res = append(res, r)
+
+	if len(res) > maxDamageRects {
+		u := res[0]
+		for _, c := range res[1:] {
+			u = u.Union(c)
+		}
+		res = append(res[:0], u)
+	}
+	return res
+}
@@ -0,0 +1,89 @@
+package spice
+
+import (
+	"image"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// refreshDriver counts display refreshes
+type refreshDriver struct {
+	testDriver
+	refresh int
+}
+
+func (dr *refreshDriver) DisplayRefresh() {
+	dr.refresh++
+}
+
+// damageDriver records the damage delivered
+type damageDriver struct {
+	refreshDriver
+	lk     sync.Mutex
+	damage [][]image.Rectangle
+}
+
+func (dr *damageDriver) DisplayDamage(display uint8, rects []image.Rectangle) {
+	dr.lk.Lock()
+	defer dr.lk.Unlock()
+	dr.damage = append(dr.damage, rects)
+}
+
+func (dr *damageDriver) calls() [][]image.Rectangle {
+	dr.lk.Lock()
+	defer dr.lk.Unlock()
+	return dr.damage
+}
+
+func TestDamage(t *testing.T) {
+	dr := &damageDriver{}
+	d := newTestDisplay()
+	d.cl.driver = dr
+	d.createSurface(0, 16, 16, true)
+	d.createSurface(1, 16, 16, false)
+
+	// damage is delivered after each draw, clipped to the surface
+	d.fill(0, Rect{Top: 2, Left: 2, Bottom: 4, Right: 4}, 0xffffffff, SpiceRopdOpPut)
+	d.fill(0, Rect{Top: 10, Left: 10, Bottom: 20, Right: 20}, 0xffffffff, SpiceRopdOpPut)
+	d.fill(1, Rect{Top: 0, Left: 0, Bottom: 4, Right: 4}, 0xffffffff, SpiceRopdOpPut)
+	assert.Equal(t, [][]image.Rectangle{{image.Rect(2, 2, 4, 4)}, {image.Rect(10, 10, 16, 16)}}, dr.calls())
+	assert.Equal(t, 0, dr.refresh)
+
+	// batched damage is merged
+	dr.damage = nil
+	d.cl.damageInterval = 10 * time.Millisecond
+	d.fill(0, Rect{Top: 2, Left: 2, Bottom: 4, Right: 4}, 0, SpiceRopdOpPut)
+	d.fill(0, Rect{Top: 0, Left: 0, Bottom: 8, Right: 8}, 0, SpiceRopdOpPut)
+	d.fill(0, Rect{Top: 8, Left: 8, Bottom: 10, Right: 10}, 0, SpiceRopdOpPut)
+	assert.Empty(t, dr.calls())
+	assert.Eventually(t, func() bool { return len(dr.calls()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, 8, 8), image.Rect(8, 8, 10, 10)}, dr.calls()[0])
+}
+
+func TestDamageRefresh(t *testing.T) {
+	// drivers without DisplayDamage are refreshed
+	dr := &refreshDriver{}
+	d := newTestDisplay()
+	d.cl.driver = dr
+	d.createSurface(0, 16, 16, true)
+
+	d.fill(0, Rect{Top: 2, Left: 2, Bottom: 4, Right: 4}, 0xffffffff, SpiceRopdOpPut)
+	d.fill(0, Rect{Top: 20, Left: 20, Bottom: 24, Right: 24}, 0xffffffff, SpiceRopdOpPut)
+	assert.Equal(t, 1, dr.refresh)
+}
+
+func TestMergeDamage(t *testing.T) {
+	var damage []image.Rectangle
+	for i := 0; i < maxDamageRects; i++ {
+		damage = mergeDamage(damage, image.Rect(i*2, 0, i*2+1, 1))
+	}
+	assert.Len(t, damage, maxDamageRects)
+	damage = mergeDamage(damage, image.Rect(0, 0, 1, 1))
+	assert.Len(t, damage, maxDamageRects)
+
+	damage = mergeDamage(damage, image.Rect(0, 5, 1, 6))
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, maxDamageRects*2-1, 6)}, damage)
+}
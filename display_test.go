@@ -0,0 +1,79 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestDisplay returns a display channel not connected to any server
+func newTestDisplay() *SpiceDisplay {
+	return &SpiceDisplay{cl: &Client{driver: testDriver{}, pixmaps: newImageCache(displayPixmapCacheSize), glz: newGlzWindow(displayGlzWindowSize)}}
+}
+
+// testMsg builds display messages, appending data referenced by pointers
+// after the fixed part of the message
+type testMsg struct {
+	bytes.Buffer
+}
+
+func (m *testMsg) put(v ...interface{}) *testMsg {
+	for _, e := range v {
+		binary.Write(m, binary.LittleEndian, e)
+	}
+	return m
+}
+
+// base writes a DisplayBase without clipping
+func (m *testMsg) base(sid uint32, r Rect) *testMsg {
+	return m.put(sid, r, uint8(0))
+}
+
+func (d *SpiceDisplay) createSurface(sid, w, h uint32, primary bool) {
+	var flags uint32
+	if primary {
+		flags = SPICE_SURFACE_FLAGS_PRIMARY
+	}
+	m := (&testMsg{}).put(sid, w, h, uint32(SPICE_SURFACE_FMT_32_xRGB), flags)
+	d.handle(SPICE_MSG_DISPLAY_SURFACE_CREATE, m.Bytes())
+}
+
+// fill sends a solid DRAW_FILL
+func (d *SpiceDisplay) fill(sid uint32, r Rect, col uint32, rop Ropd) {
+	m := (&testMsg{}).base(sid, r).put(uint8(1), col, rop, uint8(0), Point{}, uint32(0))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_FILL, m.Bytes())
+}
+
+func TestSurfaces(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 8, 8, true)
+	d.createSurface(1, 4, 4, false)
+	d.handle(SPICE_MSG_DISPLAY_MARK, nil)
+
+	assert.Equal(t, uint32(0), d.primary.id)
+	assert.Len(t, d.surfaces, 2)
+
+	// draw on the off-screen surface, then copy it to the primary surface
+	d.fill(1, Rect{Top: 0, Left: 0, Bottom: 4, Right: 4}, 0xffffffff, SpiceRopdOpPut)
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, d.surfaces[1].img.RGBAAt(1, 1))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(1, 1))
+
+	m := (&testMsg{}).base(0, Rect{Top: 2, Left: 2, Bottom: 4, Right: 4})
+	imgPtr := uint32(m.Len() + 4 + 16 + 2 + 1 + 13)
+	m.put(imgPtr, Rect{Top: 1, Left: 1, Bottom: 3, Right: 3}, SpiceRopdOpPut, uint8(0), uint8(0), Point{}, uint32(0))
+	m.put(uint64(0), uint8(SPICE_IMAGE_TYPE_SURFACE), uint8(0), uint32(4), uint32(4), uint32(1))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_COPY, m.Bytes())
+
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, d.surfaces[0].img.RGBAAt(2, 2))
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, d.surfaces[0].img.RGBAAt(3, 3))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(1, 1))
+
+	d.handle(SPICE_MSG_DISPLAY_SURFACE_DESTROY, (&testMsg{}).put(uint32(1)).Bytes())
+	assert.Len(t, d.surfaces, 1)
+
+	// draws on unknown surfaces are ignored
+	d.fill(1, Rect{Top: 0, Left: 0, Bottom: 4, Right: 4}, 0xffffffff, SpiceRopdOpPut)
+}
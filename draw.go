@@ -0,0 +1,733 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+)
+
+const (
+	SPICE_ALPHA_FLAGS_DEST_HAS_ALPHA        = 1
+	SPICE_ALPHA_FLAGS_SRC_SURFACE_HAS_ALPHA = 2
+
+	SPICE_COMPOSITE_HAS_MASK           = 1 << 19
+	SPICE_COMPOSITE_HAS_SRC_TRANSFORM  = 1 << 20
+	SPICE_COMPOSITE_HAS_MASK_TRANSFORM = 1 << 21
+)
+
+// drawSource decodes the source image of a draw operation, and returns the
+// pixels of its src area scaled to the drawing box, for positions relative
+// to the box
+func (d *SpiceDisplay) drawSource(msg []byte, ptr uint32, srcArea Rect, box Rect, mode ImageScaleMode) (func(x, y int) color.RGBA, error) {
+	img, err := d.decodeImage(msg, ptr)
+	if err != nil {
+		return nil, err
+	}
+	return scaledSource(img.Image, srcArea.Rectangle(), box.Rectangle().Size(), mode), nil
+}
+
+// drawBrush returns the brush color for positions relative to the drawing
+// box, or nil if there is no brush. Patterns are tiled from their position
+// on the surface.
+func (d *SpiceDisplay) drawBrush(msg []byte, brush *Brush, box Rect) (func(x, y int) color.RGBA, error) {
+	switch brush.Type {
+	case SPICE_BRUSH_TYPE_SOLID:
+		c := xrgb(brush.Color)
+		return func(x, y int) color.RGBA { return c }, nil
+	case SPICE_BRUSH_TYPE_PATTERN:
+		pat, err := d.decodeImage(msg, brush.ImagePtr)
+		if err != nil {
+			return nil, fmt.Errorf("pattern: %w", err)
+		}
+		b := pat.Bounds()
+		if b.Empty() {
+			return nil, errors.New("empty pattern")
+		}
+		// offset of the box in the pattern
+		ox := (int(box.Left) - int(int32(brush.Pos.X))) % b.Dx()
+		oy := (int(box.Top) - int(int32(brush.Pos.Y))) % b.Dy()
+		return func(x, y int) color.RGBA {
+			px, py := (ox+x)%b.Dx(), (oy+y)%b.Dy()
+			if px < 0 {
+				px += b.Dx()
+			}
+			if py < 0 {
+				py += b.Dy()
+			}
+			return rgbaAt(pat.Image, b.Min.X+px, b.Min.Y+py)
+		}, nil
+	}
+	return nil, nil
+}
+
+// decodeMask reads a QMask and decodes its image
+func (d *SpiceDisplay) decodeMask(msg []byte, r *bytes.Reader) QMask {
+	var qmask QMask
+	qmask.Decode(r)
+
+	if qmask.ImagePtr != 0 {
+		var err error
+		qmask.Image, err = d.decodeMaskImage(msg, qmask.ImagePtr)
+		if err != nil {
+			log.Printf("spice/display: failed to decode mask: %s", err)
+		}
+	}
+	return qmask
+}
+
+func (d *SpiceDisplay) handleDrawFill(req []byte) {
+	// DisplayBase, Brush brush, ropd, QMask
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var brush Brush
+	if err := brush.Decode(r); err != nil {
+		log.Printf("spice/display: failed to decode brush: %s", err)
+		return
+	}
+
+	// ropd rop_descriptor
+	var ropd Ropd
+	binary.Read(r, binary.LittleEndian, &ropd)
+
+	mask := d.decodeMask(req, r)
+
+	dst, area := d.target(base, &mask)
+	if dst == nil {
+		return
+	}
+
+	src, err := d.drawBrush(req, &brush, base.Box)
+	if err != nil {
+		log.Printf("spice/display: draw fill: %s", err)
+		return
+	}
+	if src == nil {
+		return
+	}
+
+	area.each(dst, func(x, y int, p []byte) {
+		ropd.ropPixel(p, src(x, y), SpiceRopdInversBrush, SpiceRopdInversDest)
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawOpaque(req []byte) {
+	// DisplayBase, Image *src_bitmap, Rect src_area, Brush brush, ropd, image_scale_mode, QMask
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var imgPtr uint32
+	binary.Read(r, binary.LittleEndian, &imgPtr)
+	srcArea := &Rect{}
+	srcArea.Decode(r)
+
+	var brush Brush
+	if err := brush.Decode(r); err != nil {
+		log.Printf("spice/display: failed to decode brush: %s", err)
+		return
+	}
+
+	var ropd Ropd
+	binary.Read(r, binary.LittleEndian, &ropd)
+	var scaleMode ImageScaleMode
+	binary.Read(r, binary.LittleEndian, &scaleMode)
+
+	mask := d.decodeMask(req, r)
+
+	dst, area := d.target(base, &mask)
+	if dst == nil {
+		return
+	}
+
+	src, err := d.drawSource(req, imgPtr, *srcArea, base.Box, scaleMode)
+	if err != nil {
+		log.Printf("failed to decode image: %s", err)
+		return
+	}
+	pat, err := d.drawBrush(req, &brush, base.Box)
+	if err != nil {
+		log.Printf("spice/display: draw opaque: %s", err)
+		return
+	}
+
+	// the source image is combined with the brush, the destination is
+	// replaced
+	area.each(dst, func(x, y int, p []byte) {
+		s := src(x, y)
+		if pat == nil {
+			p[0], p[1], p[2], p[3] = s.R, s.G, s.B, s.A
+			return
+		}
+		b := pat(x, y)
+		p[0], p[1], p[2], p[3] = b.R, b.G, b.B, s.A
+		ropd.ropPixel(p, s, SpiceRopdInversSrc, SpiceRopdInversBrush)
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawCopy(req []byte) {
+	//log.Printf("spice/display: draw copy data len=%d", len(req))
+	r := bytes.NewReader(req)
+	// display_base: uint32 surface_id Rect box (x,y,w,h) Clip clip (clip_type type int8 none|rects, if rects → uint32 num_rects, rects[num_rects])
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+	//log.Printf("display base = %+v", base)
+
+	var imgPtr uint32
+	binary.Read(r, binary.LittleEndian, &imgPtr)
+
+	// Rect src_area
+	srcArea := &Rect{}
+	srcArea.Decode(r)
+
+	// ropd rop_descriptor
+	var ropd Ropd
+	binary.Read(r, binary.LittleEndian, &ropd)
+
+	// image_scale_mode scale_mode
+	var scaleMode ImageScaleMode
+	binary.Read(r, binary.LittleEndian, &scaleMode)
+
+	// QMask mask @outvar(mask)
+	mask := d.decodeMask(req, r)
+
+	dst, area := d.target(base, &mask)
+	if dst == nil {
+		return
+	}
+
+	// decode image
+	img, err := d.decodeImage(req, imgPtr)
+	if err != nil {
+		log.Printf("failed to decode image: %s", err)
+		return
+	}
+
+	box, src := base.Box.Rectangle(), srcArea.Rectangle()
+	if ropd == SpiceRopdOpPut && area.mask == nil && src.Size() == box.Size() {
+		// plain copy, by far the most common
+		for _, r := range area.rects() {
+			draw.Draw(dst, r, img.Image, src.Min.Add(r.Min.Sub(box.Min)), draw.Src)
+			if area.opaque {
+				opaqueRect(dst, r)
+			}
+		}
+	} else {
+		pixel := scaledSource(img.Image, src, box.Size(), scaleMode)
+		area.each(dst, func(x, y int, p []byte) {
+			ropd.ropPixel(p, pixel(x, y), SpiceRopdInversSrc, SpiceRopdInversDest)
+		})
+	}
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawBlend(req []byte) {
+	// DisplayBase, Image *src_bitmap, Rect src_area, ropd, image_scale_mode, QMask
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var imgPtr uint32
+	binary.Read(r, binary.LittleEndian, &imgPtr)
+	srcArea := &Rect{}
+	srcArea.Decode(r)
+
+	var ropd Ropd
+	binary.Read(r, binary.LittleEndian, &ropd)
+	var scaleMode ImageScaleMode
+	binary.Read(r, binary.LittleEndian, &scaleMode)
+
+	mask := d.decodeMask(req, r)
+
+	dst, area := d.target(base, &mask)
+	if dst == nil {
+		return
+	}
+
+	src, err := d.drawSource(req, imgPtr, *srcArea, base.Box, scaleMode)
+	if err != nil {
+		log.Printf("failed to decode image: %s", err)
+		return
+	}
+
+	area.each(dst, func(x, y int, p []byte) {
+		ropd.ropPixel(p, src(x, y), SpiceRopdInversSrc, SpiceRopdInversDest)
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+// handleDrawFixed handles DRAW_BLACKNESS, DRAW_WHITENESS and DRAW_INVERS,
+// which only have a DisplayBase and a QMask
+func (d *SpiceDisplay) handleDrawFixed(req []byte, ropd Ropd) {
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	mask := d.decodeMask(req, r)
+
+	dst, area := d.target(base, &mask)
+	if dst == nil {
+		return
+	}
+
+	area.each(dst, func(x, y int, p []byte) {
+		ropd.ropPixel(p, color.RGBA{}, 0, 0)
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawRop3(req []byte) {
+	// DisplayBase, Image *src_bitmap, Rect src_area, Brush brush, uint8 rop3, image_scale_mode, QMask
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var imgPtr uint32
+	binary.Read(r, binary.LittleEndian, &imgPtr)
+	srcArea := &Rect{}
+	srcArea.Decode(r)
+
+	var brush Brush
+	if err := brush.Decode(r); err != nil {
+		log.Printf("spice/display: failed to decode brush: %s", err)
+		return
+	}
+
+	var code uint8
+	binary.Read(r, binary.LittleEndian, &code)
+	var scaleMode ImageScaleMode
+	binary.Read(r, binary.LittleEndian, &scaleMode)
+
+	mask := d.decodeMask(req, r)
+
+	dst, area := d.target(base, &mask)
+	if dst == nil {
+		return
+	}
+
+	src, err := d.drawSource(req, imgPtr, *srcArea, base.Box, scaleMode)
+	if err != nil {
+		log.Printf("failed to decode image: %s", err)
+		return
+	}
+	pat, err := d.drawBrush(req, &brush, base.Box)
+	if err != nil {
+		log.Printf("spice/display: draw rop3: %s", err)
+		return
+	}
+
+	area.each(dst, func(x, y int, p []byte) {
+		s := src(x, y)
+		var b color.RGBA
+		if pat != nil {
+			b = pat(x, y)
+		}
+		p[0] = rop3(code, b.R, s.R, p[0])
+		p[1] = rop3(code, b.G, s.G, p[1])
+		p[2] = rop3(code, b.B, s.B, p[2])
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawTransparent(req []byte) {
+	// DisplayBase, Image *src_bitmap, Rect src_area, uint32 src_color, uint32 true_color
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var imgPtr uint32
+	binary.Read(r, binary.LittleEndian, &imgPtr)
+	srcArea := &Rect{}
+	srcArea.Decode(r)
+
+	var srcColor, trueColor uint32
+	binary.Read(r, binary.LittleEndian, &srcColor)
+	binary.Read(r, binary.LittleEndian, &trueColor)
+
+	dst, area := d.target(base, nil)
+	if dst == nil {
+		return
+	}
+
+	// the color key must match exactly, no interpolation
+	src, err := d.drawSource(req, imgPtr, *srcArea, base.Box, ImageScaleModeNearest)
+	if err != nil {
+		log.Printf("failed to decode image: %s", err)
+		return
+	}
+
+	// pixels of the transparent color are left untouched
+	transparent := xrgb(srcColor)
+	area.each(dst, func(x, y int, p []byte) {
+		s := src(x, y)
+		if s.R == transparent.R && s.G == transparent.G && s.B == transparent.B {
+			return
+		}
+		p[0], p[1], p[2] = s.R, s.G, s.B
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawAlphaBlend(req []byte) {
+	// DisplayBase, uint8 alpha_flags, uint8 alpha, Image *src_bitmap, Rect src_area
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var flags, alpha uint8
+	binary.Read(r, binary.LittleEndian, &flags)
+	binary.Read(r, binary.LittleEndian, &alpha)
+	var imgPtr uint32
+	binary.Read(r, binary.LittleEndian, &imgPtr)
+	srcArea := &Rect{}
+	srcArea.Decode(r)
+
+	dst, area := d.target(base, nil)
+	if dst == nil {
+		return
+	}
+
+	src, err := d.drawSource(req, imgPtr, *srcArea, base.Box, ImageScaleModeInterpolate)
+	if err != nil {
+		log.Printf("failed to decode image: %s", err)
+		return
+	}
+
+	a := uint32(alpha)
+	area.each(dst, func(x, y int, p []byte) {
+		s := src(x, y)
+		if flags&SPICE_ALPHA_FLAGS_SRC_SURFACE_HAS_ALPHA == 0 {
+			s.A = 0xff
+		}
+		// source faded by alpha, over the destination
+		s = color.RGBA{
+			R: uint8((uint32(s.R)*a + 127) / 255),
+			G: uint8((uint32(s.G)*a + 127) / 255),
+			B: uint8((uint32(s.B)*a + 127) / 255),
+			A: uint8((uint32(s.A)*a + 127) / 255),
+		}
+		da := p[3]
+		composite(compositeOpOver, p, s)
+		if flags&SPICE_ALPHA_FLAGS_DEST_HAS_ALPHA == 0 {
+			p[3] = da
+		}
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawComposite(req []byte) {
+	// DisplayBase, uint32 flags, Image *src_bitmap, [Image *mask_bitmap],
+	// [Transform src_transform], [Transform mask_transform], Point16
+	// src_origin, Point16 mask_origin
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var flags, srcPtr, maskPtr uint32
+	binary.Read(r, binary.LittleEndian, &flags)
+	binary.Read(r, binary.LittleEndian, &srcPtr)
+	if flags&SPICE_COMPOSITE_HAS_MASK != 0 {
+		binary.Read(r, binary.LittleEndian, &maskPtr)
+	}
+	var srcTransform, maskTransform *Transform
+	if flags&SPICE_COMPOSITE_HAS_SRC_TRANSFORM != 0 {
+		srcTransform = &Transform{}
+		srcTransform.Decode(r)
+	}
+	if flags&SPICE_COMPOSITE_HAS_MASK_TRANSFORM != 0 {
+		maskTransform = &Transform{}
+		maskTransform.Decode(r)
+	}
+	var srcOrigin, maskOrigin Point16
+	srcOrigin.Decode(r)
+	if err := maskOrigin.Decode(r); err != nil {
+		log.Printf("spice/display: draw composite packet too short")
+		return
+	}
+
+	dst, area := d.target(base, nil)
+	if dst == nil {
+		return
+	}
+
+	img, err := d.decodeImage(req, srcPtr)
+	if err != nil {
+		log.Printf("failed to decode image: %s", err)
+		return
+	}
+	// op in bits 0-7, repeat modes in bits 14-15 (source) and 16-17 (mask)
+	op := uint8(flags)
+	src := &compositeSource{img: img.Image, transform: srcTransform, repeat: int(flags>>14) & 3, origin: image.Pt(int(srcOrigin.X), int(srcOrigin.Y))}
+
+	var mask *compositeSource
+	if maskPtr != 0 {
+		m, err := d.decodeImage(req, maskPtr)
+		if err != nil {
+			log.Printf("failed to decode mask: %s", err)
+			return
+		}
+		mask = &compositeSource{img: m.Image, transform: maskTransform, repeat: int(flags>>16) & 3, origin: image.Pt(int(maskOrigin.X), int(maskOrigin.Y))}
+	}
+
+	var unsupported bool
+	area.each(dst, func(x, y int, p []byte) {
+		s := src.at(x, y)
+		if mask != nil {
+			// component alpha is approximated by the mask alpha
+			a := uint32(mask.at(x, y).A)
+			s = color.RGBA{
+				R: uint8((uint32(s.R)*a + 127) / 255),
+				G: uint8((uint32(s.G)*a + 127) / 255),
+				B: uint8((uint32(s.B)*a + 127) / 255),
+				A: uint8((uint32(s.A)*a + 127) / 255),
+			}
+		}
+		if !composite(op, p, s) {
+			unsupported = true
+		}
+	})
+	if unsupported {
+		log.Printf("spice/display: unsupported composite operator %d", op)
+	}
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawStroke(req []byte) {
+	// DisplayBase, Path *path, LineAttr attr, Brush brush, uint16 fore_mode, uint16 back_mode
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var pathPtr uint32
+	binary.Read(r, binary.LittleEndian, &pathPtr)
+
+	// LineAttr: uint8 flags, if STYLED uint8 style_nseg and fixed28_4 *style
+	var attr LineAttr
+	binary.Read(r, binary.LittleEndian, &attr.Flags)
+	if attr.Flags&SPICE_LINE_FLAGS_STYLED != 0 {
+		var nseg uint8
+		var stylePtr uint32
+		binary.Read(r, binary.LittleEndian, &nseg)
+		binary.Read(r, binary.LittleEndian, &stylePtr)
+		if stylePtr == 0 || uint64(stylePtr)+uint64(nseg)*4 > uint64(len(req)) {
+			log.Printf("spice/display: invalid line style")
+			return
+		}
+		attr.Style = make([]int32, nseg)
+		for i := range attr.Style {
+			attr.Style[i] = int32(binary.LittleEndian.Uint32(req[stylePtr+uint32(i)*4:]))
+		}
+	}
+
+	var brush Brush
+	if err := brush.Decode(r); err != nil {
+		log.Printf("spice/display: failed to decode brush: %s", err)
+		return
+	}
+
+	// back_mode only matters for GDI's opaque styled lines, which the
+	// server does not send
+	var foreMode, backMode Ropd
+	binary.Read(r, binary.LittleEndian, &foreMode)
+	binary.Read(r, binary.LittleEndian, &backMode)
+
+	dst, area := d.target(base, nil)
+	if dst == nil {
+		return
+	}
+
+	segs, err := parsePath(req, pathPtr)
+	if err != nil {
+		log.Printf("spice/display: draw stroke: %s", err)
+		return
+	}
+	src, err := d.drawBrush(req, &brush, base.Box)
+	if err != nil {
+		log.Printf("spice/display: draw stroke: %s", err)
+		return
+	}
+	if src == nil {
+		return
+	}
+
+	box := base.Box.Rectangle()
+	strokePixels(flattenPath(segs), attr, func(x, y int) {
+		if !area.contains(x, y) {
+			return
+		}
+		o := dst.PixOffset(x, y)
+		foreMode.ropPixel(dst.Pix[o:o+4:o+4], src(x-box.Min.X, y-box.Min.Y), SpiceRopdInversBrush, SpiceRopdInversDest)
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleDrawText(req []byte) {
+	// DisplayBase, String *str, Rect back_area, Brush fore_brush, Brush back_brush, uint16 fore_mode, uint16 back_mode
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var strPtr uint32
+	binary.Read(r, binary.LittleEndian, &strPtr)
+	backArea := &Rect{}
+	backArea.Decode(r)
+
+	var foreBrush, backBrush Brush
+	if err := foreBrush.Decode(r); err != nil {
+		log.Printf("spice/display: failed to decode brush: %s", err)
+		return
+	}
+	if err := backBrush.Decode(r); err != nil {
+		log.Printf("spice/display: failed to decode brush: %s", err)
+		return
+	}
+
+	var foreMode, backMode Ropd
+	binary.Read(r, binary.LittleEndian, &foreMode)
+	binary.Read(r, binary.LittleEndian, &backMode)
+
+	dst, area := d.target(base, nil)
+	if dst == nil {
+		return
+	}
+
+	glyphs, err := parseString(req, strPtr)
+	if err != nil {
+		log.Printf("spice/display: draw text: %s", err)
+		return
+	}
+	fore, err := d.drawBrush(req, &foreBrush, base.Box)
+	if err != nil {
+		log.Printf("spice/display: draw text: %s", err)
+		return
+	}
+	back, err := d.drawBrush(req, &backBrush, base.Box)
+	if err != nil {
+		log.Printf("spice/display: draw text: %s", err)
+		return
+	}
+
+	box := base.Box.Rectangle()
+
+	// background first, then the glyphs on top of it
+	if back != nil {
+		ba := backArea.Rectangle().Intersect(box)
+		area.eachIn(dst, ba, func(x, y int, p []byte) {
+			backMode.ropPixel(p, back(x+ba.Min.X-box.Min.X, y+ba.Min.Y-box.Min.Y), SpiceRopdInversBrush, SpiceRopdInversDest)
+		})
+	}
+
+	if fore != nil {
+		for i := range glyphs {
+			g := &glyphs[i]
+			gr := g.Rectangle()
+			area.eachIn(dst, gr, func(gx, gy int, p []byte) {
+				a := int(g.Alpha[gy*g.Width+gx])
+				if a == 0 {
+					return
+				}
+				var res [4]byte
+				copy(res[:], p)
+				foreMode.ropPixel(res[:], fore(gr.Min.X+gx-box.Min.X, gr.Min.Y+gy-box.Min.Y), SpiceRopdInversBrush, SpiceRopdInversDest)
+				// anti-aliased glyphs blend the result with the destination
+				for c := 0; c < 4; c++ {
+					p[c] = byte((int(res[c])*a + int(p[c])*(255-a) + 127) / 255)
+				}
+			})
+		}
+	}
+	d.refresh(base.Surface, area.rects()...)
+}
+
+func (d *SpiceDisplay) handleCopyBits(req []byte) {
+	// DisplayBase, Point src_pos
+	r := bytes.NewReader(req)
+	base := &DisplayBase{}
+	err := base.Decode(r)
+	if err != nil {
+		log.Printf("failed to decode display base: %s", err)
+		return
+	}
+
+	var srcPos Point
+	if err := srcPos.Decode(r); err != nil {
+		log.Printf("spice/display: copy bits packet too short")
+		return
+	}
+
+	dst, area := d.target(base, nil)
+	if dst == nil {
+		return
+	}
+
+	// source and destination usually overlap when scrolling, so copy the
+	// source first. Only the source of the area, clipped to the surface, is
+	// needed.
+	from := area.box.Add(image.Pt(int(srcPos.X), int(srcPos.Y)).Sub(base.Box.Rectangle().Min))
+	src := from.Intersect(dst.Rect)
+	tmp := image.NewRGBA(src)
+	draw.Draw(tmp, src, dst, src.Min, draw.Src)
+
+	area.each(dst, func(x, y int, p []byte) {
+		sp := from.Min.Add(image.Pt(x, y))
+		if !sp.In(src) {
+			// source outside of the surface
+			return
+		}
+		o := tmp.PixOffset(sp.X, sp.Y)
+		copy(p, tmp.Pix[o:o+4])
+	})
+	d.refresh(base.Surface, area.rects()...)
+}
@@ -0,0 +1,204 @@
+package spice
+
+import (
+	"encoding/binary"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// surfaceImage appends an image referencing surface sid to the message and
+// stores its offset at ptrOfs
+func (m *testMsg) surfaceImage(ptrOfs int, sid, w, h uint32) []byte {
+	ptr := uint32(m.Len())
+	m.put(uint64(0), uint8(SPICE_IMAGE_TYPE_SURFACE), uint8(0), w, h, sid)
+	b := m.Bytes()
+	binary.LittleEndian.PutUint32(b[ptrOfs:], ptr)
+	return b
+}
+
+func TestRopd(t *testing.T) {
+	assert.Equal(t, byte(0x0f), SpiceRopdOpPut.rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0xf0), (SpiceRopdOpPut|SpiceRopdInversSrc).rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0x0f), (SpiceRopdOpPut|SpiceRopdInversBrush).rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0xaf), SpiceRopdOpOr.rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0x0a), SpiceRopdOpAnd.rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0xa0), (SpiceRopdOpAnd|SpiceRopdInversDest).rop(0xff, 0x5f, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0x5a), (SpiceRopdOpXor|SpiceRopdInversRes).rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0x55), SpiceRopdOpInvers.rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0x00), SpiceRopdOpBlackness.rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+	assert.Equal(t, byte(0xff), SpiceRopdOpWhiteness.rop(0x0f, 0xaa, SpiceRopdInversSrc, SpiceRopdInversDest))
+}
+
+func TestRop3(t *testing.T) {
+	p, s, dst := byte(0xf0), byte(0xcc), byte(0xaa)
+	assert.Equal(t, s, rop3(0xcc, p, s, dst))       // SRCCOPY
+	assert.Equal(t, p, rop3(0xf0, p, s, dst))       // PATCOPY
+	assert.Equal(t, p^dst, rop3(0x5a, p, s, dst))   // PATINVERT
+	assert.Equal(t, s&dst, rop3(0x88, p, s, dst))   // SRCAND
+	assert.Equal(t, ^dst, rop3(0x55, p, s, dst))    // DSTINVERT
+	assert.Equal(t, byte(0), rop3(0x00, p, s, dst)) // BLACKNESS
+}
+
+func TestDrawOperations(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 4, 4, true)
+	d.createSurface(1, 4, 4, false)
+	box := Rect{Top: 0, Left: 0, Bottom: 2, Right: 2}
+
+	// brush colors are xRGB
+	d.fill(0, box, 0x00102030, SpiceRopdOpPut)
+	assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, d.surfaces[0].img.RGBAAt(1, 1))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(2, 2))
+
+	d.fill(0, box, 0x00ffffff, SpiceRopdOpXor)
+	assert.Equal(t, color.RGBA{0xef, 0xdf, 0xcf, 0xff}, d.surfaces[0].img.RGBAAt(1, 1))
+
+	d.handle(SPICE_MSG_DISPLAY_DRAW_INVERS, (&testMsg{}).base(0, box).put(uint8(0), Point{}, uint32(0)).Bytes())
+	assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, d.surfaces[0].img.RGBAAt(1, 1))
+
+	d.handle(SPICE_MSG_DISPLAY_DRAW_WHITENESS, (&testMsg{}).base(0, box).put(uint8(0), Point{}, uint32(0)).Bytes())
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, d.surfaces[0].img.RGBAAt(0, 0))
+
+	d.handle(SPICE_MSG_DISPLAY_DRAW_BLACKNESS, (&testMsg{}).base(0, box).put(uint8(0), Point{}, uint32(0)).Bytes())
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(0, 0))
+
+	// source surface: left column white, the rest red
+	d.fill(1, Rect{Top: 0, Left: 0, Bottom: 4, Right: 4}, 0x00ff0000, SpiceRopdOpPut)
+	d.fill(1, Rect{Top: 0, Left: 0, Bottom: 4, Right: 1}, 0x00ffffff, SpiceRopdOpPut)
+
+	// transparent: white pixels are skipped
+	d.fill(0, box, 0x000000ff, SpiceRopdOpPut)
+	m := (&testMsg{}).base(0, box)
+	ptrOfs := m.Len()
+	m.put(uint32(0), Rect{Top: 0, Left: 0, Bottom: 2, Right: 2}, uint32(0xffffff), uint32(0))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_TRANSPARENT, m.surfaceImage(ptrOfs, 1, 4, 4))
+	assert.Equal(t, color.RGBA{0, 0, 0xff, 0xff}, d.surfaces[0].img.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{0xff, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(1, 0))
+
+	// alpha blend: half red over black
+	d.fill(0, box, 0, SpiceRopdOpPut)
+	m = (&testMsg{}).base(0, box).put(uint8(0), uint8(0x80))
+	ptrOfs = m.Len()
+	m.put(uint32(0), Rect{Top: 0, Left: 1, Bottom: 2, Right: 3})
+	d.handle(SPICE_MSG_DISPLAY_DRAW_ALPHA_BLEND, m.surfaceImage(ptrOfs, 1, 4, 4))
+	assert.Equal(t, color.RGBA{0x80, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(0, 0))
+
+	// rop3 SRCPAINT (source OR destination)
+	d.fill(0, box, 0x000000ff, SpiceRopdOpPut)
+	m = (&testMsg{}).base(0, box)
+	ptrOfs = m.Len()
+	m.put(uint32(0), Rect{Top: 0, Left: 1, Bottom: 2, Right: 3}, uint8(SPICE_BRUSH_TYPE_NONE), uint8(0xee), uint8(0), uint8(0), Point{}, uint32(0))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_ROP3, m.surfaceImage(ptrOfs, 1, 4, 4))
+	assert.Equal(t, color.RGBA{0xff, 0, 0xff, 0xff}, d.surfaces[0].img.RGBAAt(1, 1))
+
+	// composite OVER without mask
+	d.fill(0, box, 0, SpiceRopdOpPut)
+	m = (&testMsg{}).base(0, box).put(uint32(compositeOpOver))
+	ptrOfs = m.Len()
+	m.put(uint32(0), Point16{X: 1}, Point16{})
+	d.handle(SPICE_MSG_DISPLAY_DRAW_COMPOSITE, m.surfaceImage(ptrOfs, 1, 4, 4))
+	assert.Equal(t, color.RGBA{0xff, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(1, 1))
+}
+
+func TestComposite(t *testing.T) {
+	p := []byte{0, 0, 0xff, 0xff}
+	assert.True(t, composite(compositeOpOver, p, color.RGBA{0x80, 0, 0, 0x80}))
+	assert.Equal(t, []byte{0x80, 0, 0x7f, 0xff}, p)
+
+	p = []byte{0x10, 0x20, 0x30, 0xff}
+	assert.True(t, composite(compositeOpClear, p, color.RGBA{0xff, 0xff, 0xff, 0xff}))
+	assert.Equal(t, []byte{0, 0, 0, 0}, p)
+
+	assert.False(t, composite(0x30, p, color.RGBA{}))
+}
+
+func TestCopyBits(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 1, 4, true)
+	for y := uint32(0); y < 4; y++ {
+		d.fill(0, Rect{Top: y, Left: 0, Bottom: y + 1, Right: 1}, 0x010101*(y+1), SpiceRopdOpPut)
+	}
+
+	// scroll up by one line, the source overlaps the destination
+	m := (&testMsg{}).base(0, Rect{Top: 0, Left: 0, Bottom: 3, Right: 1}).put(Point{X: 0, Y: 1})
+	d.handle(SPICE_MSG_DISPLAY_COPY_BITS, m.Bytes())
+
+	img := d.surfaces[0].img
+	for y := 0; y < 3; y++ {
+		assert.Equal(t, uint8(y+2), img.RGBAAt(0, y).R)
+	}
+	assert.Equal(t, uint8(4), img.RGBAAt(0, 3).R)
+
+	// and down again
+	m = (&testMsg{}).base(0, Rect{Top: 1, Left: 0, Bottom: 4, Right: 1}).put(Point{X: 0, Y: 0})
+	d.handle(SPICE_MSG_DISPLAY_COPY_BITS, m.Bytes())
+	for y := 1; y < 4; y++ {
+		assert.Equal(t, uint8(y+1), img.RGBAAt(0, y).R)
+	}
+
+	// boxes are clipped to the surface before copying, sources outside of
+	// the surface are ignored
+	m = (&testMsg{}).base(0, Rect{Top: 2, Left: 0, Bottom: 0xffffffff, Right: 0xffffffff}).put(Point{X: 0, Y: 3})
+	d.handle(SPICE_MSG_DISPLAY_COPY_BITS, m.Bytes())
+	assert.Equal(t, uint8(2), img.RGBAAt(0, 1).R)
+	assert.Equal(t, uint8(4), img.RGBAAt(0, 2).R)
+	assert.Equal(t, uint8(4), img.RGBAAt(0, 3).R)
+}
+
+func TestPatternBrush(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 4, 2, true)
+	d.createSurface(1, 2, 1, false)
+
+	// pattern: white then red
+	d.fill(1, Rect{Top: 0, Left: 0, Bottom: 1, Right: 1}, 0xffffff, SpiceRopdOpPut)
+	d.fill(1, Rect{Top: 0, Left: 1, Bottom: 1, Right: 2}, 0xff0000, SpiceRopdOpPut)
+
+	// tiled from x=1, starting the box at x=0 shifts the tile by one pixel
+	m := (&testMsg{}).base(0, Rect{Top: 0, Left: 0, Bottom: 2, Right: 4})
+	ptrOfs := m.Len() + 1
+	m.put(uint8(SPICE_BRUSH_TYPE_PATTERN), uint32(0), Point{X: 1, Y: 0}, SpiceRopdOpPut, uint8(0), Point{}, uint32(0))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_FILL, m.surfaceImage(ptrOfs, 1, 2, 1))
+
+	white, red := color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0xff, 0, 0, 0xff}
+	img := d.surfaces[0].img
+	for y := 0; y < 2; y++ {
+		assert.Equal(t, red, img.RGBAAt(0, y))
+		assert.Equal(t, white, img.RGBAAt(1, y))
+		assert.Equal(t, red, img.RGBAAt(2, y))
+		assert.Equal(t, white, img.RGBAAt(3, y))
+	}
+
+	// patterns combine with the destination like solid brushes
+	m = (&testMsg{}).base(0, Rect{Top: 0, Left: 0, Bottom: 2, Right: 4})
+	m.put(uint8(SPICE_BRUSH_TYPE_PATTERN), uint32(0), Point{}, SpiceRopdOpXor, uint8(0), Point{}, uint32(0))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_FILL, m.surfaceImage(ptrOfs, 1, 2, 1))
+	assert.Equal(t, color.RGBA{0, 0xff, 0xff, 0xff}, img.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{0, 0xff, 0xff, 0xff}, img.RGBAAt(1, 0))
+}
+
+func TestPatternBrushNegativeOrigin(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 4, 1, true)
+	d.createSurface(1, 3, 1, false)
+
+	// pattern: white, red then blue
+	d.fill(1, Rect{Top: 0, Left: 0, Bottom: 1, Right: 1}, 0xffffff, SpiceRopdOpPut)
+	d.fill(1, Rect{Top: 0, Left: 1, Bottom: 1, Right: 2}, 0xff0000, SpiceRopdOpPut)
+	d.fill(1, Rect{Top: 0, Left: 2, Bottom: 1, Right: 3}, 0x0000ff, SpiceRopdOpPut)
+
+	// the origin is signed: tiled from x=-1, x=0 is the second pattern pixel
+	m := (&testMsg{}).base(0, Rect{Top: 0, Left: 0, Bottom: 1, Right: 4})
+	ptrOfs := m.Len() + 1
+	m.put(uint8(SPICE_BRUSH_TYPE_PATTERN), uint32(0), int32(-1), int32(0), SpiceRopdOpPut, uint8(0), Point{}, uint32(0))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_FILL, m.surfaceImage(ptrOfs, 1, 3, 1))
+
+	white, red, blue := color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}
+	img := d.surfaces[0].img
+	assert.Equal(t, red, img.RGBAAt(0, 0))
+	assert.Equal(t, blue, img.RGBAAt(1, 0))
+	assert.Equal(t, white, img.RGBAAt(2, 0))
+	assert.Equal(t, red, img.RGBAAt(3, 0))
+}
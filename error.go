@@ -1,6 +1,12 @@
 package spice
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned by Client.Err once Close has been called
+var ErrClosed = errors.New("spice: client closed")
 
 type SpiceError uint32
 
@@ -0,0 +1,226 @@
+package spice
+
+import "fmt"
+
+// Event is a session state change reported through Client.Events. It is one
+// of the types defined below.
+type Event interface {
+	fmt.Stringer
+	isEvent()
+}
+
+// NotifySeverity is the severity of a server notification
+type NotifySeverity uint32
+
+const (
+	NotifyInfo NotifySeverity = iota
+	NotifyWarn
+	NotifyError
+)
+
+func (s NotifySeverity) String() string {
+	switch s {
+	case NotifyInfo:
+		return "info"
+	case NotifyWarn:
+		return "warn"
+	case NotifyError:
+		return "error"
+	default:
+		return fmt.Sprintf("NotifySeverity(%d)", s)
+	}
+}
+
+// NotifyVisibility tells how prominently a server notification should be shown
+type NotifyVisibility uint32
+
+const (
+	NotifyLow NotifyVisibility = iota
+	NotifyMedium
+	NotifyHigh
+)
+
+func (v NotifyVisibility) String() string {
+	switch v {
+	case NotifyLow:
+		return "low"
+	case NotifyMedium:
+		return "medium"
+	case NotifyHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("NotifyVisibility(%d)", v)
+	}
+}
+
+// ChannelConnected is sent once a channel has been linked
+type ChannelConnected struct {
+	Channel Channel
+	ID      uint8
+	Secure  bool // connected over TLS
+}
+
+// ChannelLost is sent when an established channel connection fails
+type ChannelLost struct {
+	Channel Channel
+	ID      uint8
+	Err     error
+}
+
+// ChannelFailed is sent when a channel announced by the server could not be
+// linked
+type ChannelFailed struct {
+	Channel Channel
+	ID      uint8
+	Err     error
+}
+
+// ServerNotify is a message the server wants to be shown to the user
+type ServerNotify struct {
+	Channel    Channel
+	Time       uint64 // server timestamp
+	Severity   NotifySeverity
+	Visibility NotifyVisibility
+	What       uint32 // error/warning/info code
+	Message    string
+}
+
+// ServerDisconnecting is sent when the server announces it is about to close
+// a channel
+type ServerDisconnecting struct {
+	Channel Channel
+	ID      uint8
+}
+
+// AgentConnected is sent when the guest agent becomes available
+type AgentConnected struct{}
+
+// AgentDisconnected is sent when the guest agent goes away
+type AgentDisconnected struct{}
+
+// MouseModeChanged is sent when the server changes the mouse mode, one of
+// SPICE_MOUSE_MODE_SERVER or SPICE_MOUSE_MODE_CLIENT
+type MouseModeChanged struct {
+	Mode      uint32
+	Supported uint32 // bitmask of supported modes
+}
+
+// Reconnecting is sent when the main channel was lost and the client is
+// trying to establish a new session (see WithReconnect)
+type Reconnecting struct {
+	Err error
+}
+
+// Reconnected is sent once a new session has been established
+type Reconnected struct {
+	Session uint32
+}
+
+// Migrating is sent when the server starts migrating the virtual machine to
+// another host and the client connects to it
+type Migrating struct {
+	Target   MigrationTarget
+	Seamless bool // seamless migration was requested
+}
+
+// Migrated is sent once all channels have been switched to the migration target
+type Migrated struct {
+	Target MigrationTarget
+}
+
+func (ChannelConnected) isEvent()    {}
+func (ChannelLost) isEvent()         {}
+func (ChannelFailed) isEvent()       {}
+func (ServerNotify) isEvent()        {}
+func (ServerDisconnecting) isEvent() {}
+func (AgentConnected) isEvent()      {}
+func (AgentDisconnected) isEvent()   {}
+func (MouseModeChanged) isEvent()    {}
+func (Reconnecting) isEvent()        {}
+func (Reconnected) isEvent()         {}
+func (Migrating) isEvent()           {}
+func (Migrated) isEvent()            {}
+
+func (e ChannelConnected) String() string {
+	return fmt.Sprintf("channel %s[%d] connected (secure=%v)", e.Channel, e.ID, e.Secure)
+}
+
+func (e ChannelLost) String() string {
+	return fmt.Sprintf("channel %s[%d] lost: %s", e.Channel, e.ID, e.Err)
+}
+
+func (e ChannelFailed) String() string {
+	return fmt.Sprintf("channel %s[%d] failed: %s", e.Channel, e.ID, e.Err)
+}
+
+func (e ServerNotify) String() string {
+	return fmt.Sprintf("server notify from %s: severity=%s visibility=%s what=%d: %s", e.Channel, e.Severity, e.Visibility, e.What, e.Message)
+}
+
+func (e ServerDisconnecting) String() string {
+	return fmt.Sprintf("server disconnecting channel %s[%d]", e.Channel, e.ID)
+}
+
+func (AgentConnected) String() string {
+	return "agent connected"
+}
+
+func (AgentDisconnected) String() string {
+	return "agent disconnected"
+}
+
+func (e MouseModeChanged) String() string {
+	return fmt.Sprintf("mouse mode changed to %d (supported=%d)", e.Mode, e.Supported)
+}
+
+func (e Reconnecting) String() string {
+	return fmt.Sprintf("reconnecting: %s", e.Err)
+}
+
+func (e Reconnected) String() string {
+	return fmt.Sprintf("reconnected, session %d", e.Session)
+}
+
+func (e Migrating) String() string {
+	return fmt.Sprintf("migrating to %s (seamless=%v)", e.Target, e.Seamless)
+}
+
+func (e Migrated) String() string {
+	return fmt.Sprintf("migrated to %s", e.Target)
+}
+
+// eventsBuffer is the number of events kept for a slow reader before new
+// events are dropped
+const eventsBuffer = 64
+
+// Events returns the channel session events are delivered on. Events are
+// dropped if the channel is full, so it should be read continuously. The
+// channel is closed once the session has ended, after Done.
+func (client *Client) Events() <-chan Event {
+	return client.events
+}
+
+// emit delivers an event without blocking
+func (client *Client) emit(ev Event) {
+	client.eventsLk.Lock()
+	defer client.eventsLk.Unlock()
+
+	if client.eventsClosed {
+		return
+	}
+	select {
+	case client.events <- ev:
+	default:
+		if l := client.Debug; l != nil {
+			l.Printf("spice: events channel full, dropped event: %s", ev)
+		}
+	}
+}
+
+func (client *Client) closeEvents() {
+	client.eventsLk.Lock()
+	defer client.eventsLk.Unlock()
+
+	client.eventsClosed = true
+	close(client.events)
+}
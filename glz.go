@@ -0,0 +1,371 @@
+package spice
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// GLZ dictionary window size announced in SPICE_MSGC_DISPLAY_INIT, in pixels
+	displayGlzWindowSize = 32 * 1024 * 1024 / 4
+	// GLZ dictionary shared by all display channels
+	displayGlzDictionaryID = 1
+
+	// how long to wait for an image referenced by a GLZ image to be decoded
+	// by another display channel
+	glzWaitTimeout = 2 * time.Second
+
+	glzHeaderSize = 36
+)
+
+// glzWindow is the GLZ global dictionary: images decoded so far, which new
+// images can reference. It is shared by the display channels of a session.
+type glzWindow struct {
+	lk     sync.Mutex
+	cond   *sync.Cond
+	max    int64 // maximum size in pixels
+	size   int64
+	images map[uint64][]byte // decoded pixels by image id, in decoding order
+}
+
+func newGlzWindow(max int64) *glzWindow {
+	w := &glzWindow{max: max, images: make(map[uint64][]byte)}
+	w.cond = sync.NewCond(&w.lk)
+	return w
+}
+
+// add stores a decoded image and releases the images the server will no
+// longer reference: those more than headDist images older than id, and the
+// oldest ones if the window grows past its size
+func (w *glzWindow) add(id uint64, pix []byte, headDist uint32) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	for oid, opix := range w.images {
+		if oid+uint64(headDist) < id {
+			delete(w.images, oid)
+			w.size -= int64(len(opix) / 4)
+		}
+	}
+
+	w.images[id] = pix
+	w.size += int64(len(pix) / 4)
+
+	for w.size > w.max && len(w.images) > 1 {
+		oldest := id
+		for oid := range w.images {
+			if oid < oldest {
+				oldest = oid
+			}
+		}
+		w.size -= int64(len(w.images[oldest]) / 4)
+		delete(w.images, oldest)
+	}
+	w.cond.Broadcast()
+}
+
+// get returns the pixels of an image, waiting for a short while in case
+// another display channel is decoding it
+func (w *glzWindow) get(id uint64) ([]byte, error) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	var timedOut bool
+	t := time.AfterFunc(glzWaitTimeout, func() {
+		w.lk.Lock()
+		timedOut = true
+		w.cond.Broadcast()
+		w.lk.Unlock()
+	})
+	defer t.Stop()
+
+	for {
+		if pix, ok := w.images[id]; ok {
+			return pix, nil
+		}
+		if timedOut {
+			return nil, fmt.Errorf("glz: image %d not found in window", id)
+		}
+		w.cond.Wait()
+	}
+}
+
+func (w *glzWindow) clear() {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	w.images = make(map[uint64][]byte)
+	w.size = 0
+}
+
+// zlibGlzImage decodes SPICE_IMAGE_TYPE_ZLIB_GLZ_RGB: GLZ data compressed with zlib
+func (w *glzWindow) zlibGlzImage(buf []byte) (image.Image, error) {
+	if len(buf) < 8 {
+		return nil, errors.New("not enough data for zlib glz image")
+	}
+	glzSize := binary.LittleEndian.Uint32(buf[:4])
+	dataSize := binary.LittleEndian.Uint32(buf[4:8])
+	if uint64(len(buf)) < 8+uint64(dataSize) {
+		return nil, errors.New("data is missing")
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(buf[8 : 8+dataSize]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	glz := make([]byte, glzSize)
+	if _, err := io.ReadFull(zr, glz); err != nil {
+		return nil, fmt.Errorf("zlib glz: %w", err)
+	}
+	return w.glzImage(glz)
+}
+
+// glzImage decodes a GLZ image and adds it to the window
+func (w *glzWindow) glzImage(buf []byte) (image.Image, error) {
+	if len(buf) < glzHeaderSize {
+		return nil, errors.New("not enough data for glz image")
+	}
+	if string(buf[:4]) != "  ZL" {
+		return nil, errors.New("invalid magic for GLZ image")
+	}
+
+	// magic, version, type (with top down flag), width, height, stride, id, win_head_dist
+	typ := LzImageType(binary.BigEndian.Uint32(buf[8:12]) & 0x0f)
+	topDown := binary.BigEndian.Uint32(buf[8:12])>>4 != 0
+	width := binary.BigEndian.Uint32(buf[12:16])
+	height := binary.BigEndian.Uint32(buf[16:20])
+	id := binary.BigEndian.Uint64(buf[24:32])
+	headDist := binary.BigEndian.Uint32(buf[32:36])
+
+	if uint64(width)*uint64(height) > 64*1024*1024 {
+		return nil, errors.New("glz: image too large")
+	}
+
+	d := &glzDecoder{in: bytes.NewReader(buf[glzHeaderSize:]), w: w, id: id}
+	pix := make([]byte, int(width)*int(height)*4)
+
+	var err error
+	switch typ {
+	case LZ_IMAGE_TYPE_RGB32, LZ_IMAGE_TYPE_RGB24:
+		err = d.decode(pix, glzModeRGB32)
+		setOpaque(pix)
+	case LZ_IMAGE_TYPE_RGB16:
+		err = d.decode(pix, glzModeRGB16)
+		setOpaque(pix)
+	case LZ_IMAGE_TYPE_RGBA:
+		err = d.decode(pix, glzModeRGB32)
+		if err == nil {
+			err = d.decode(pix, glzModeAlpha)
+		}
+	default:
+		return nil, fmt.Errorf("glz: unsupported type %s", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.add(id, pix, headDist)
+
+	img := &image.RGBA{Pix: pix, Stride: int(width) * 4, Rect: image.Rect(0, 0, int(width), int(height))}
+	if !topDown {
+		// makes a copy, the window keeps the pixels in decoding order
+		reverseImgRGBA(img)
+	}
+	return img, nil
+}
+
+func setOpaque(pix []byte) {
+	for i := 3; i < len(pix); i += 4 {
+		pix[i] = 0xff
+	}
+}
+
+type glzMode int
+
+const (
+	glzModeRGB32 glzMode = iota // 3 bytes per pixel (also used for RGB24)
+	glzModeRGB16                // 2 bytes per pixel, RGB555 big endian
+	glzModeAlpha                // alpha channel only
+)
+
+type glzDecoder struct {
+	in *bytes.Reader
+	w  *glzWindow
+	id uint64 // id of the image being decoded
+}
+
+// decode decodes one GLZ stream into out, adapted from spice-gtk's
+// decode-glz-tmpl.c
+func (d *glzDecoder) decode(out []byte, mode glzMode) error {
+	limit := len(out) / 4
+	op := 0
+
+	for op < limit {
+		ctrl, err := d.in.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if ctrl < 32 {
+			// literal pixels, count biased by 1
+			n := int(ctrl) + 1
+			if op+n > limit {
+				return errors.New("glz: literal run past end of image")
+			}
+			for ; n > 0; n-- {
+				if err := d.literal(out[op*4:], mode); err != nil {
+					return err
+				}
+				op++
+			}
+			continue
+		}
+
+		// reference: length, pixel offset and image distance
+		ln := int(ctrl >> 5)
+		pixelFlag := (ctrl >> 4) & 1
+		pixelOfs := int(ctrl & 0x0f)
+
+		if ln == 7 {
+			for {
+				code, err := d.in.ReadByte()
+				if err != nil {
+					return err
+				}
+				ln += int(code)
+				if code != 0xff {
+					break
+				}
+			}
+		}
+		code, err := d.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		pixelOfs += int(code) << 4
+
+		code, err = d.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		imageFlag := int(code>>6) & 3
+		var imageDist uint64
+
+		if pixelFlag == 0 {
+			// short pixel offset
+			imageDist = uint64(code & 0x3f)
+			for i := 0; i < imageFlag; i++ {
+				code, err = d.in.ReadByte()
+				if err != nil {
+					return err
+				}
+				imageDist += uint64(code) << (6 + 8*i)
+			}
+		} else {
+			longOfs := (code >> 5) & 1
+			pixelOfs += int(code&0x1f) << 12
+			for i := 0; i < imageFlag; i++ {
+				code, err = d.in.ReadByte()
+				if err != nil {
+					return err
+				}
+				imageDist += uint64(code) << (8 * i)
+			}
+			if longOfs != 0 {
+				code, err = d.in.ReadByte()
+				if err != nil {
+					return err
+				}
+				pixelOfs += int(code) << 17
+			}
+		}
+
+		// length bias
+		switch mode {
+		case glzModeAlpha:
+			ln += 2
+		case glzModeRGB16:
+			ln += 1
+		}
+		if op+ln > limit {
+			return errors.New("glz: reference past end of image")
+		}
+
+		var ref []byte
+		var refPos int
+		if imageDist == 0 {
+			// reference within the image, offset biased by 1
+			pixelOfs += 1
+			if pixelOfs > op {
+				return fmt.Errorf("glz: back reference pointing to before start of data (%d -= %d)", op, pixelOfs)
+			}
+			ref, refPos = out, op-pixelOfs
+		} else {
+			if imageDist > d.id {
+				return errors.New("glz: invalid image distance")
+			}
+			ref, err = d.w.get(d.id - imageDist)
+			if err != nil {
+				return err
+			}
+			refPos = pixelOfs
+			if refPos+ln > len(ref)/4 {
+				return errors.New("glz: reference past end of referenced image")
+			}
+		}
+
+		// copy pixel by pixel, runs reference the previous pixel
+		for ; ln > 0; ln-- {
+			o, r := op*4, refPos*4
+			if mode == glzModeAlpha {
+				out[o+3] = ref[r+3]
+			} else {
+				out[o], out[o+1], out[o+2] = ref[r], ref[r+1], ref[r+2]
+			}
+			op++
+			refPos++
+		}
+	}
+	return nil
+}
+
+// literal reads a single pixel
+func (d *glzDecoder) literal(out []byte, mode glzMode) error {
+	switch mode {
+	case glzModeAlpha:
+		a, err := d.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		out[3] = a
+	case glzModeRGB16:
+		hi, err := d.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		lo, err := d.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		p := uint16(hi)<<8 | uint16(lo)
+		r, g, b := uint8(p>>10)&0x1f, uint8(p>>5)&0x1f, uint8(p)&0x1f
+		out[0], out[1], out[2] = r<<3|r>>2, g<<3|g>>2, b<<3|b>>2
+	default:
+		// b, g, r
+		var px [3]byte
+		if _, err := io.ReadFull(d.in, px[:]); err != nil {
+			return err
+		}
+		out[0], out[1], out[2] = px[2], px[1], px[0]
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package spice
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testGlz builds a top down RGB32 GLZ image
+func testGlz(id uint64, w, h uint32, data ...byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("  ZL")
+	binary.Write(buf, binary.BigEndian, []uint32{0x00010001, uint32(LZ_IMAGE_TYPE_RGB32) | 1<<4, w, h, w * 4})
+	binary.Write(buf, binary.BigEndian, id)
+	binary.Write(buf, binary.BigEndian, uint32(10))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestGlzImage(t *testing.T) {
+	w := newGlzWindow(1024)
+
+	// two literal pixels, stored b, g, r
+	img, err := w.glzImage(testGlz(1, 2, 1, 0x01, 0x30, 0x20, 0x10, 0x03, 0x02, 0x01))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, img.(*image.RGBA).RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{0x01, 0x02, 0x03, 0xff}, img.(*image.RGBA).RGBAAt(1, 0))
+
+	// 2 pixels from the previous image, then 2 pixels repeating the last one
+	img, err = w.glzImage(testGlz(2, 4, 1, 0x40, 0x00, 0x01, 0x40, 0x00, 0x00))
+	if !assert.Nil(t, err) {
+		return
+	}
+	rgba := img.(*image.RGBA)
+	assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, rgba.RGBAAt(0, 0))
+	for x := 1; x < 4; x++ {
+		assert.Equal(t, color.RGBA{0x01, 0x02, 0x03, 0xff}, rgba.RGBAAt(x, 0))
+	}
+
+	// references past the end of the image fail
+	_, err = w.glzImage(testGlz(3, 1, 1, 0x40, 0x00, 0x01))
+	assert.NotNil(t, err)
+
+	// a reset empties the dictionary
+	w.clear()
+	assert.Len(t, w.images, 0)
+}
+
+func TestZlibGlzImage(t *testing.T) {
+	d := newTestDisplay()
+
+	z := &bytes.Buffer{}
+	zw := zlib.NewWriter(z)
+	glz := testGlz(1, 1, 1, 0x00, 0x30, 0x20, 0x10)
+	zw.Write(glz)
+	zw.Close()
+
+	m := (&testMsg{}).put(uint32(0))
+	m.put(uint64(1), uint8(SPICE_IMAGE_TYPE_ZLIB_GLZ_RGB), uint8(0), uint32(1), uint32(1))
+	m.put(uint32(len(glz)), uint32(z.Len()))
+	m.Write(z.Bytes())
+
+	img, err := d.decodeImage(m.Bytes(), 4)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, img.Image.(*image.RGBA).RGBAAt(0, 0))
+	assert.Len(t, d.cl.glz.images, 1)
+}
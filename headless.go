@@ -0,0 +1,215 @@
+package spice
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"sync"
+)
+
+// Headless is a Driver keeping the display in memory, for tests and bots
+// driving a guest without a GUI. Only the first display is followed.
+//
+// The display is copied as it is updated, so Snapshot can be called from
+// any goroutine.
+type Headless struct {
+	lk      sync.Mutex
+	src     *image.RGBA   // primary surface, only read from driver callbacks
+	fb      *image.RGBA   // copy of src as of the last update
+	changed chan struct{} // closed and replaced when fb changes
+
+	cursor     image.Image
+	cursorX    uint16
+	cursorY    uint16
+	inputs     *ChInputs
+	main       *ChMain
+	clipboards map[SpiceClipboardSelection][]SpiceClipboardFormat
+}
+
+// NewHeadless returns a Headless driver, to pass to New
+func NewHeadless() *Headless {
+	return &Headless{changed: make(chan struct{})}
+}
+
+// notify wakes up goroutines waiting for a change, with h.lk held
+func (h *Headless) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *Headless) DisplayInit(img image.Image) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(img.Bounds())
+		draw.Draw(src, src.Rect, img, img.Bounds().Min, draw.Src)
+	}
+	h.src = src
+	h.fb = image.NewRGBA(src.Rect)
+	copy(h.fb.Pix, src.Pix)
+	h.notify()
+}
+
+func (h *Headless) DisplayRefresh() {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	if h.src != nil {
+		h.update(h.src.Rect)
+	}
+}
+
+// DisplayDamage implements DamageDriver, only copying the areas changed
+func (h *Headless) DisplayDamage(display uint8, rects []image.Rectangle) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	if h.src == nil || display != 0 {
+		return
+	}
+	for _, r := range rects {
+		h.update(r)
+	}
+}
+
+// update copies r from the surface, with h.lk held
+func (h *Headless) update(r image.Rectangle) {
+	r = r.Intersect(h.fb.Rect)
+	if r.Empty() {
+		return
+	}
+	draw.Draw(h.fb, r, h.src, r.Min, draw.Src)
+	h.notify()
+}
+
+func (h *Headless) SetEventsTarget(inputs *ChInputs) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.inputs = inputs
+}
+
+func (h *Headless) SetMainTarget(main *ChMain) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.main = main
+}
+
+func (h *Headless) SetCursor(img image.Image, x, y uint16) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	h.cursor, h.cursorX, h.cursorY = img, x, y
+}
+
+func (h *Headless) ClipboardGrabbed(selection SpiceClipboardSelection, clipboardTypes []SpiceClipboardFormat) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	if h.clipboards == nil {
+		h.clipboards = make(map[SpiceClipboardSelection][]SpiceClipboardFormat)
+	}
+	h.clipboards[selection] = clipboardTypes
+}
+
+func (h *Headless) ClipboardFetch(selection SpiceClipboardSelection, clType SpiceClipboardFormat) ([]byte, error) {
+	return nil, errors.New("spice: headless driver has no clipboard")
+}
+
+func (h *Headless) ClipboardRelease(selection SpiceClipboardSelection) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	delete(h.clipboards, selection)
+}
+
+// Inputs returns the inputs channel, to send keyboard and mouse events, or
+// nil if not connected yet
+func (h *Headless) Inputs() *ChInputs {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	return h.inputs
+}
+
+// Main returns the main channel, or nil if not connected yet
+func (h *Headless) Main() *ChMain {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	return h.main
+}
+
+// ClipboardFormats returns the formats the guest offers for a clipboard
+// selection it grabbed
+func (h *Headless) ClipboardFormats(selection SpiceClipboardSelection) []SpiceClipboardFormat {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	return h.clipboards[selection]
+}
+
+// Snapshot returns a copy of the display, or nil if the display was not
+// initialized yet
+func (h *Headless) Snapshot() image.Image {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	return h.snapshot()
+}
+
+func (h *Headless) snapshot() image.Image {
+	if h.fb == nil {
+		return nil
+	}
+	img := image.NewRGBA(h.fb.Rect)
+	copy(img.Pix, h.fb.Pix)
+	return img
+}
+
+// Cursor returns the cursor image, nil if hidden, and the position passed
+// to SetCursor
+func (h *Headless) Cursor() (img image.Image, x, y uint16) {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+	return h.cursor, h.cursorX, h.cursorY
+}
+
+// WaitChange waits for the display to change, and returns its new content
+func (h *Headless) WaitChange(ctx context.Context) (image.Image, error) {
+	h.lk.Lock()
+	changed := h.changed
+	h.lk.Unlock()
+
+	select {
+	case <-changed:
+		return h.Snapshot(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WaitFor waits until cond returns true for the display, checking it now
+// and after each change. It returns the display matching cond.
+func (h *Headless) WaitFor(ctx context.Context, cond func(image.Image) bool) (image.Image, error) {
+	for {
+		h.lk.Lock()
+		img, changed := h.snapshot(), h.changed
+		h.lk.Unlock()
+
+		if img != nil && cond(img) {
+			return img, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// WritePNG encodes the display to w as a PNG image
+func (h *Headless) WritePNG(w io.Writer) error {
+	img := h.Snapshot()
+	if img == nil {
+		return errors.New("spice: display not initialized")
+	}
+	return png.Encode(w, img)
+}
@@ -0,0 +1,55 @@
+package spice
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadless(t *testing.T) {
+	h := NewHeadless()
+	d := newTestDisplay()
+	d.cl.driver = h
+	assert.Nil(t, h.Snapshot())
+
+	d.createSurface(0, 8, 8, true)
+	d.handle(SPICE_MSG_DISPLAY_MARK, nil)
+	snap := h.Snapshot()
+	assert.Equal(t, image.Rect(0, 0, 8, 8), snap.Bounds())
+
+	// snapshots are not changed by later draws
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res := make(chan image.Image)
+	go func() {
+		img, err := h.WaitFor(ctx, func(img image.Image) bool {
+			return img.At(6, 6) == color.RGBA{0xff, 0, 0, 0xff}
+		})
+		assert.NoError(t, err)
+		res <- img
+	}()
+	d.fill(0, Rect{Top: 0, Left: 0, Bottom: 4, Right: 4}, 0xffffffff, SpiceRopdOpPut)
+	d.fill(0, Rect{Top: 4, Left: 4, Bottom: 8, Right: 8}, 0xff0000, SpiceRopdOpPut)
+
+	img := <-res
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(1, 1))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, snap.At(1, 1))
+
+	var buf bytes.Buffer
+	assert.NoError(t, h.WritePNG(&buf))
+	dec, err := png.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, img.(*image.RGBA).Pix, dec.(*image.RGBA).Pix)
+
+	// nothing changes anymore
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = h.WaitChange(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
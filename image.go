@@ -13,6 +13,21 @@ import (
 	"github.com/Shells-com/spice/quic"
 )
 
+const (
+	SPICE_IMAGE_TYPE_BITMAP              = 0
+	SPICE_IMAGE_TYPE_QUIC                = 1
+	SPICE_IMAGE_TYPE_LZ_PLT              = 100
+	SPICE_IMAGE_TYPE_LZ_RGB              = 101
+	SPICE_IMAGE_TYPE_GLZ_RGB             = 102
+	SPICE_IMAGE_TYPE_FROM_CACHE          = 103
+	SPICE_IMAGE_TYPE_SURFACE             = 104
+	SPICE_IMAGE_TYPE_JPEG                = 105
+	SPICE_IMAGE_TYPE_FROM_CACHE_LOSSLESS = 106
+	SPICE_IMAGE_TYPE_ZLIB_GLZ_RGB        = 107
+	SPICE_IMAGE_TYPE_JPEG_ALPHA          = 108
+	SPICE_IMAGE_TYPE_LZ4                 = 109
+)
+
 type Image struct {
 	image.Image
 
@@ -43,7 +58,7 @@ func DecodeImage(buf []byte) (*Image, error) {
 
 	switch i.Type {
 	case 0: // bitmap
-		img, err := bitmapImage(buf)
+		img, err := bitmapImage(buf, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -68,9 +83,9 @@ func DecodeImage(buf []byte) (*Image, error) {
 		i.Image = img
 		return i, nil
 	case 100: // lz_plt
-		// Flags: LZPALETTE_FLAG_PAL_FROM_CACHE, LZPALETTE_FLAG_PAL_CACHE_ME, etc
-		//var palette []color.RGBA
-		return nil, fmt.Errorf("todo palette lz_plt")
+		// the palette is elsewhere in the message or in the display channel
+		// palette cache, see SpiceDisplay.decodeSessionImage
+		return nil, errors.New("lz_plt images need a display channel to resolve the palette")
 	case 101: // lz_rgb
 		if len(buf) < 4 {
 			// invalid
@@ -156,6 +171,21 @@ func DecodeImage(buf []byte) (*Image, error) {
 
 		i.Image = rgba
 
+		return i, nil
+	case 109: // lz4
+		if len(buf) < 4 {
+			return nil, errors.New("invalid data for image")
+		}
+		ln := binary.LittleEndian.Uint32(buf[:4])
+		if len(buf) < 4+int(ln) {
+			return nil, errors.New("data is missing")
+		}
+
+		img, err := lz4Image(buf[4:ln+4], i.Width, i.Height)
+		if err != nil {
+			return nil, err
+		}
+		i.Image = img
 		return i, nil
 	default:
 		return nil, fmt.Errorf("unsupported image type %d", i.Type)
@@ -37,8 +37,31 @@ func lzImage(buf []byte, palette []color.RGBA, img *image.RGBA) (image.Image, er
 	//log.Printf("spice/lz: decoding image version=%d type=%s %dx%d stride=%d top_down=%d", vers, typ, width, height, stride, top_down)
 	_ = vers // avoid unused error when log is commented
 
+	// palette images are decoded a whole row of stride bytes at a time
+	var ppb uint32 // pixels per byte
+	switch typ {
+	case LZ_IMAGE_TYPE_PLT1_LE, LZ_IMAGE_TYPE_PLT1_BE:
+		ppb = 8
+	case LZ_IMAGE_TYPE_PLT4_LE, LZ_IMAGE_TYPE_PLT4_BE:
+		ppb = 2
+	case LZ_IMAGE_TYPE_PLT8:
+		ppb = 1
+	}
+	if ppb != 0 {
+		if palette == nil {
+			return nil, fmt.Errorf("lz: no palette for type %s", typ)
+		}
+		if stride*ppb < width {
+			return nil, errors.New("lz: stride too small for palette image")
+		}
+		stride *= ppb * 4
+	}
+
 	// build image directly so we guarantee the right stride
 	if img == nil {
+		if uint64(stride)*uint64(height) > 256*1024*1024 {
+			return nil, errors.New("lz: image too large")
+		}
 		img = &image.RGBA{Pix: make([]byte, stride*height), Stride: int(stride), Rect: image.Rectangle{Min: image.Point{0, 0}, Max: image.Point{int(width), int(height)}}}
 	}
 
@@ -57,6 +80,11 @@ func lzImage(buf []byte, palette []color.RGBA, img *image.RGBA) (image.Image, er
 				return nil, err
 			}
 		}
+	case LZ_IMAGE_TYPE_PLT1_LE, LZ_IMAGE_TYPE_PLT1_BE, LZ_IMAGE_TYPE_PLT4_LE, LZ_IMAGE_TYPE_PLT4_BE, LZ_IMAGE_TYPE_PLT8:
+		err := lzDecompress(lzBuf, img, typ, true, palette, false)
+		if err != nil {
+			return nil, err
+		}
 	case LZ_IMAGE_TYPE_XXXA:
 		// alpha layer only
 		err := lzDecompress(lzBuf, img, typ, false, nil, true)
@@ -159,6 +187,9 @@ func lzDecompress(in io.ByteReader, out *image.RGBA, typ LzImageType, defaultAlp
 				return fmt.Errorf("lz: back reference pointing to before start of data (ref(%d) -= %d)", ref, ofs)
 			}
 			ref -= ofs
+			if op+ln > outBufLen {
+				return fmt.Errorf("lz: reference past end of image (%d + %d > %d)", op, ln, outBufLen)
+			}
 			if ref == op-1 {
 				//plt4/1 what?
 				b := ref // this "b" var seems useless
@@ -199,121 +230,94 @@ func lzDecompress(in io.ByteReader, out *image.RGBA, typ LzImageType, defaultAlp
 				}
 			}
 		} else {
-			//COPY_COMP_PIXEL
-			ctrl += 1
-
-			if typ == LZ_IMAGE_TYPE_XXXA {
-				code, err := in.ReadByte()
+			//COPY_COMP_PIXEL, ctrl+1 literals
+			for i := uint32(ctrl) + 1; i > 0; i -= 1 {
+				n, err := lzLiteral(in, outBuf[op*4:], typ, defaultAlpha, palette, opaque)
 				if err != nil {
 					return err
 				}
+				op += n
+			}
+		}
+	}
 
-				if opaque {
-					outBuf[op4+3] = 0xff
-				} else {
-					outBuf[op4+3] = code
-				}
-			} else if palette != nil {
-				switch typ {
-				case LZ_IMAGE_TYPE_PLT1_LE:
-					// TODO
-					return errors.New("TODO LZ_IMAGE_TYPE_PLT1_LE 1")
-				case LZ_IMAGE_TYPE_PLT1_BE:
-					// TODO
-					return errors.New("TODO LZ_IMAGE_TYPE_PLT1_BE 1")
-				case LZ_IMAGE_TYPE_PLT4_LE:
-					// TODO
-					return errors.New("TODO LZ_IMAGE_TYPE_PLT4_LE 1")
-				case LZ_IMAGE_TYPE_PLT4_BE:
-					// TODO
-					return errors.New("TODO LZ_IMAGE_TYPE_PLT4_BE 1")
-				case LZ_IMAGE_TYPE_PLT8:
-					posPal, err := in.ReadByte()
-					if err != nil {
-						return err
-					}
-					copyPixel(op4, palette[posPal], outBuf)
-					if defaultAlpha {
-						outBuf[op4+3] = 0xff
-					}
-				}
-			} else {
-				code, err := in.ReadByte()
-				if err != nil {
-					return err
-				}
-				outBuf[op4+2] = code
-				code, err = in.ReadByte()
-				if err != nil {
-					return err
-				}
-				outBuf[op4+1] = code
-				code, err = in.ReadByte()
-				if err != nil {
-					return err
-				}
-				outBuf[op4+0] = code
+	return nil
+}
 
-				if defaultAlpha {
-					outBuf[op4+3] = 0xff
-				}
-			}
-			op += 1
+// lzLiteral reads a literal into out, and returns the number of pixels
+// written: palette images pack 2 (PLT4) or 8 (PLT1) pixels per literal
+func lzLiteral(in io.ByteReader, out []byte, typ LzImageType, defaultAlpha bool, palette []color.RGBA, opaque bool) (uint32, error) {
+	if typ == LZ_IMAGE_TYPE_XXXA {
+		code, err := in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if len(out) < 4 {
+			return 0, errors.New("lz: literal past end of image")
+		}
+		if opaque {
+			out[3] = 0xff
+		} else {
+			out[3] = code
+		}
+		return 1, nil
+	}
 
-			// for (--ctrl; ctrl; ctrl--) {
-			for i := ctrl - 1; i > 0; i -= 1 {
-				//COPY_COMP_PIXEL
-				op4 = op * 4 // faster?
-				if typ == LZ_IMAGE_TYPE_XXXA {
-					code, err := in.ReadByte()
-					if err != nil {
-						return err
-					}
-					if opaque {
-						outBuf[op4+3] = 0xff
-					} else {
-						outBuf[op4+3] = code
-					}
-				} else if palette != nil {
-					switch typ {
-					case LZ_IMAGE_TYPE_PLT1_LE:
-						return errors.New("TODO LZ_IMAGE_TYPE_PLT1_LE 2")
-					case LZ_IMAGE_TYPE_PLT1_BE:
-						return errors.New("TODO LZ_IMAGE_TYPE_PLT1_BE 2")
-					case LZ_IMAGE_TYPE_PLT4_LE:
-						return errors.New("TODO LZ_IMAGE_TYPE_PLT4_LE 2")
-					case LZ_IMAGE_TYPE_PLT4_BE:
-						return errors.New("TODO LZ_IMAGE_TYPE_PLT4_BE 2")
-					case LZ_IMAGE_TYPE_PLT8:
-						return errors.New("TODO LZ_IMAGE_TYPE_PLT8 2")
-					}
-				} else {
-					code, err := in.ReadByte()
-					if err != nil {
-						return err
-					}
-					outBuf[op4+2] = code
-					code, err = in.ReadByte()
-					if err != nil {
-						return err
-					}
-					outBuf[op4+1] = code
-					code, err = in.ReadByte()
-					if err != nil {
-						return err
-					}
-					outBuf[op4+0] = code
+	if palette != nil {
+		code, err := in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
 
-					if defaultAlpha {
-						outBuf[op4+3] = 0xff
-					}
-				}
-				op += 1
+		var idx []byte
+		switch typ {
+		case LZ_IMAGE_TYPE_PLT1_LE:
+			for b := 0; b < 8; b++ {
+				idx = append(idx, code>>b&1)
+			}
+		case LZ_IMAGE_TYPE_PLT1_BE:
+			for b := 7; b >= 0; b-- {
+				idx = append(idx, code>>b&1)
 			}
+		case LZ_IMAGE_TYPE_PLT4_LE:
+			idx = []byte{code & 0x0f, code >> 4}
+		case LZ_IMAGE_TYPE_PLT4_BE:
+			idx = []byte{code >> 4, code & 0x0f}
+		case LZ_IMAGE_TYPE_PLT8:
+			idx = []byte{code}
+		default:
+			return 0, fmt.Errorf("lz: palette given for type %s", typ)
+		}
+
+		if len(out) < len(idx)*4 {
+			return 0, errors.New("lz: literal past end of image")
 		}
+		for i, v := range idx {
+			if int(v) >= len(palette) {
+				return 0, fmt.Errorf("lz: palette index %d out of range", v)
+			}
+			copyPixel(uint32(i*4), palette[v], out)
+			if defaultAlpha {
+				out[i*4+3] = 0xff
+			}
+		}
+		return uint32(len(idx)), nil
 	}
 
-	return nil
+	if len(out) < 4 {
+		return 0, errors.New("lz: literal past end of image")
+	}
+	for i := 2; i >= 0; i-- {
+		code, err := in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		out[i] = code
+	}
+	if defaultAlpha {
+		out[3] = 0xff
+	}
+	return 1, nil
 }
 
 func copyPixel(op4 uint32, col color.RGBA, outBuf []byte) {
@@ -0,0 +1,149 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// lz4Image decodes SPICE_IMAGE_TYPE_LZ4 data: a top down flag, a bitmap
+// format, then LZ4 blocks each prefixed with their big endian size. Blocks
+// are decoded as a single stream, so they can reference previous blocks.
+func lz4Image(buf []byte, width, height uint32) (image.Image, error) {
+	if len(buf) < 2 {
+		return nil, errors.New("not enough data for lz4 image")
+	}
+	topDown := buf[0] != 0
+	format := BitmapImageType(buf[1])
+	buf = buf[2:]
+
+	var bpp int
+	switch format {
+	case BITMAP_IMAGE_TYPE_16BIT:
+		bpp = 2
+	case BITMAP_IMAGE_TYPE_24BIT:
+		bpp = 3
+	case BITMAP_IMAGE_TYPE_32BIT, BITMAP_IMAGE_TYPE_RGBA:
+		bpp = 4
+	default:
+		return nil, fmt.Errorf("lz4: unsupported format %d", format)
+	}
+	if uint64(width)*uint64(height) > 64*1024*1024 {
+		return nil, errors.New("lz4: image too large")
+	}
+
+	dec := make([]byte, int(width)*int(height)*bpp)
+	op := 0
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, errors.New("lz4: truncated block header")
+		}
+		ln := binary.BigEndian.Uint32(buf[:4])
+		if uint64(len(buf)) < 4+uint64(ln) {
+			return nil, errors.New("lz4: truncated block")
+		}
+		n, err := lz4DecodeBlock(buf[4:4+ln], dec, op)
+		if err != nil {
+			return nil, err
+		}
+		op = n
+		buf = buf[4+ln:]
+	}
+	if op != len(dec) {
+		return nil, fmt.Errorf("lz4: decoded %d bytes, expected %d", op, len(dec))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	pix := img.Pix
+	for i, o := 0, 0; i < len(dec); i, o = i+bpp, o+4 {
+		switch format {
+		case BITMAP_IMAGE_TYPE_16BIT:
+			// x1r5g5b5
+			p := binary.LittleEndian.Uint16(dec[i:])
+			r, g, b := uint8(p>>10)&0x1f, uint8(p>>5)&0x1f, uint8(p)&0x1f
+			pix[o], pix[o+1], pix[o+2], pix[o+3] = r<<3|r>>2, g<<3|g>>2, b<<3|b>>2, 0xff
+		case BITMAP_IMAGE_TYPE_RGBA:
+			pix[o], pix[o+1], pix[o+2], pix[o+3] = dec[i+2], dec[i+1], dec[i], dec[i+3]
+		default:
+			// BGR or BGRX
+			pix[o], pix[o+1], pix[o+2], pix[o+3] = dec[i+2], dec[i+1], dec[i], 0xff
+		}
+	}
+
+	if !topDown {
+		reverseImgRGBA(img)
+	}
+	return img, nil
+}
+
+// lz4DecodeBlock decodes a LZ4 block into out starting at op, and returns the
+// new position in out. Matches can reference anything already in out.
+func lz4DecodeBlock(in, out []byte, op int) (int, error) {
+	ip := 0
+	for ip < len(in) {
+		token := in[ip]
+		ip++
+
+		// literals
+		ln := int(token >> 4)
+		if ln == 15 {
+			for {
+				if ip >= len(in) {
+					return op, errors.New("lz4: truncated literal length")
+				}
+				b := in[ip]
+				ip++
+				ln += int(b)
+				if b != 0xff {
+					break
+				}
+			}
+		}
+		if ip+ln > len(in) || op+ln > len(out) {
+			return op, errors.New("lz4: literals out of bounds")
+		}
+		op += copy(out[op:], in[ip:ip+ln])
+		ip += ln
+
+		if ip == len(in) {
+			// the last sequence only has literals
+			break
+		}
+
+		// match
+		if ip+2 > len(in) {
+			return op, errors.New("lz4: truncated match offset")
+		}
+		ofs := int(binary.LittleEndian.Uint16(in[ip:]))
+		ip += 2
+		if ofs == 0 || ofs > op {
+			return op, fmt.Errorf("lz4: invalid match offset %d at %d", ofs, op)
+		}
+
+		ln = int(token & 0x0f)
+		if ln == 15 {
+			for {
+				if ip >= len(in) {
+					return op, errors.New("lz4: truncated match length")
+				}
+				b := in[ip]
+				ip++
+				ln += int(b)
+				if b != 0xff {
+					break
+				}
+			}
+		}
+		ln += 4
+		if op+ln > len(out) {
+			return op, errors.New("lz4: match out of bounds")
+		}
+		// byte by byte, matches can overlap the output
+		for i := 0; i < ln; i++ {
+			out[op] = out[op-ofs]
+			op++
+		}
+	}
+	return op, nil
+}
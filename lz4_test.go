@@ -0,0 +1,40 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLz4Image(t *testing.T) {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{1, byte(BITMAP_IMAGE_TYPE_32BIT)})
+
+	// first block: one BGRX pixel as literals
+	block := []byte{0x40, 0x30, 0x20, 0x10, 0x00}
+	binary.Write(buf, binary.BigEndian, uint32(len(block)))
+	buf.Write(block)
+
+	// second block: two pixels matching the first block, then a literal pixel
+	block = []byte{0x04, 0x04, 0x00, 0x40, 0x03, 0x02, 0x01, 0x00}
+	binary.Write(buf, binary.BigEndian, uint32(len(block)))
+	buf.Write(block)
+
+	img, err := lz4Image(buf.Bytes(), 4, 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	rgba := img.(*image.RGBA)
+	for x := 0; x < 3; x++ {
+		assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, rgba.RGBAAt(x, 0))
+	}
+	assert.Equal(t, color.RGBA{0x01, 0x02, 0x03, 0xff}, rgba.RGBAAt(3, 0))
+
+	// offsets before the start of the stream are rejected
+	_, err = lz4Image([]byte{1, byte(BITMAP_IMAGE_TYPE_32BIT), 0, 0, 0, 3, 0x00, 0x04, 0x00}, 2, 1)
+	assert.NotNil(t, err)
+}
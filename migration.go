@@ -0,0 +1,418 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// MigrationTarget describes the server a session is being migrated to, as
+// sent by the source server
+type MigrationTarget struct {
+	Host        string
+	Port        uint16 // plain text port, 0 if none
+	TLSPort     uint16 // TLS port, 0 if none
+	HostSubject string // expected certificate subject of the target, if any
+}
+
+func (t MigrationTarget) String() string {
+	return fmt.Sprintf("%s (port=%d tls-port=%d)", t.Host, t.Port, t.TLSPort)
+}
+
+// MigrationConnector is implemented by connectors able to follow a live
+// migration of the virtual machine to another host. Sessions using other
+// connectors are refused migration by the client, and will typically be
+// disconnected by the server once the migration completes.
+type MigrationConnector interface {
+	Connector
+	// SpiceMigrate returns a Connector for the migration target
+	SpiceMigrate(dst MigrationTarget) (Connector, error)
+}
+
+// SpiceMigrate returns a copy of the connector pointed at the migration
+// target. CA and public key settings are kept, the host subject is replaced
+// by the target's if the server provided one.
+func (t *TLSConnector) SpiceMigrate(dst MigrationTarget) (Connector, error) {
+	n := *t
+	n.Addr, n.TLSAddr, n.ServerName = "", "", ""
+	if dst.Port != 0 {
+		n.Addr = net.JoinHostPort(dst.Host, strconv.Itoa(int(dst.Port)))
+	}
+	if dst.TLSPort != 0 {
+		n.TLSAddr = net.JoinHostPort(dst.Host, strconv.Itoa(int(dst.TLSPort)))
+	}
+	if n.Addr == "" && n.TLSAddr == "" {
+		return nil, errors.New("spice: migration target has no port")
+	}
+	if dst.HostSubject != "" {
+		n.HostSubject = dst.HostSubject
+	}
+	return &n, nil
+}
+
+// migrateTimeout is how long we wait for the target to answer the seamless
+// migration request
+const migrateTimeout = 10 * time.Second
+
+// migration holds the state of a migration in progress
+type migration struct {
+	dst      MigrationTarget
+	c        Connector                 // connector for the target
+	seamless bool                      // seamless migration was accepted by the target
+	ready    bool                      // all channels are connected to the target
+	conns    map[*SpiceConn]*SpiceConn // source channel connection => target connection
+	waitData map[*SpiceConn]bool       // channels waiting for SPICE_MSG_MIGRATE_DATA
+	switched map[*SpiceConn]bool       // channels already using the target connection
+}
+
+// parseMigrationTarget parses a SpiceMigrationDstInfo structure, also used
+// by SPICE_MSG_MAIN_MIGRATE_SWITCH_HOST
+func parseMigrationTarget(data []byte) (MigrationTarget, error) {
+	var res MigrationTarget
+	if len(data) < 20 {
+		return res, errors.New("spice: migration info too short")
+	}
+
+	// port, sport, host_size, host_data, cert_subject_size, cert_subject_data
+	port := binary.LittleEndian.Uint16(data[0:2])
+	sport := binary.LittleEndian.Uint16(data[2:4])
+	if port != 0xffff {
+		res.Port = port
+	}
+	if sport != 0xffff {
+		res.TLSPort = sport
+	}
+
+	host, err := migrationString(data, binary.LittleEndian.Uint32(data[4:8]), binary.LittleEndian.Uint32(data[8:12]))
+	if err != nil {
+		return res, err
+	}
+	if host == "" {
+		return res, errors.New("spice: migration target has no host")
+	}
+	res.Host = host
+
+	res.HostSubject, err = migrationString(data, binary.LittleEndian.Uint32(data[12:16]), binary.LittleEndian.Uint32(data[16:20]))
+	return res, err
+}
+
+// migrationString reads a zero terminated string located at offset ptr in the message
+func migrationString(data []byte, size, ptr uint32) (string, error) {
+	if size == 0 || ptr == 0 {
+		return "", nil
+	}
+	if uint64(ptr)+uint64(size) > uint64(len(data)) {
+		return "", errors.New("spice: migration info out of bounds")
+	}
+	s := data[ptr : ptr+size]
+	for len(s) > 0 && s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+	return string(s), nil
+}
+
+// migrationConnector returns a Connector for dst
+func (client *Client) migrationConnector(dst MigrationTarget) (Connector, error) {
+	mc, ok := client.connector().(MigrationConnector)
+	if !ok {
+		return nil, errors.New("spice: connector does not support migration")
+	}
+	return mc.SpiceMigrate(dst)
+}
+
+// migrateBegin connects all channels to the migration target, then tells the
+// source server whether the client is ready to be migrated
+func (client *Client) migrateBegin(dst MigrationTarget, seamless bool, srcVersion uint32) {
+	main := client.main
+
+	c, err := client.migrationConnector(dst)
+	if err != nil {
+		log.Printf("spice: cannot migrate to %s: %s", dst, err)
+		main.conn.WriteMessage(SPICE_MSGC_MAIN_MIGRATE_CONNECT_ERROR)
+		return
+	}
+
+	mig := &migration{
+		dst:      dst,
+		c:        c,
+		conns:    make(map[*SpiceConn]*SpiceConn),
+		waitData: make(map[*SpiceConn]bool),
+		switched: make(map[*SpiceConn]bool),
+	}
+
+	client.migLk.Lock()
+	if old := client.migration; old != nil {
+		old.close()
+	}
+	client.migration = mig
+	client.migLk.Unlock()
+
+	client.emit(Migrating{Target: dst, Seamless: seamless})
+
+	err = client.migrateConnect(mig, main.conn, seamless, srcVersion)
+
+	client.migLk.Lock()
+	defer client.migLk.Unlock()
+
+	if client.migration != mig {
+		// cancelled while connecting
+		mig.close()
+		return
+	}
+	if err != nil {
+		log.Printf("spice: migration to %s failed: %s", dst, err)
+		mig.close()
+		client.migration = nil
+		main.conn.WriteMessage(SPICE_MSGC_MAIN_MIGRATE_CONNECT_ERROR)
+		return
+	}
+
+	mig.ready = true
+	if mig.seamless {
+		main.conn.WriteMessage(SPICE_MSGC_MAIN_MIGRATE_CONNECTED_SEAMLESS)
+	} else {
+		main.conn.WriteMessage(SPICE_MSGC_MAIN_MIGRATE_CONNECTED)
+	}
+	log.Printf("spice: connected to migration target %s (seamless=%v)", dst, mig.seamless)
+}
+
+// migrateConnect links the main channel, then all other channels, to the target
+func (client *Client) migrateConnect(mig *migration, src *SpiceConn, seamless bool, srcVersion uint32) error {
+	dstMain, err := client.dial(mig.c, ChannelMain, 0, src.reqCaps)
+	if err != nil {
+		return err
+	}
+	if !mig.add(client, src, dstMain) {
+		return errors.New("spice: migration cancelled")
+	}
+
+	if seamless {
+		mig.seamless, err = negotiateSeamless(dstMain, srcVersion)
+		if err != nil {
+			return err
+		}
+		if !mig.seamless {
+			log.Printf("spice: migration target refused seamless migration, falling back to semi-seamless")
+		}
+	}
+
+	// snapshot of the channels to migrate
+	client.connsLk.Lock()
+	var srcs []*SpiceConn
+	for c := range client.conns {
+		if c != src {
+			srcs = append(srcs, c)
+		}
+	}
+	client.connsLk.Unlock()
+
+	for _, c := range srcs {
+		dst, err := client.dial(mig.c, c.typ, c.id, c.reqCaps)
+		if err != nil {
+			return fmt.Errorf("channel %s: %w", c.String(), err)
+		}
+		if !mig.add(client, c, dst) {
+			return errors.New("spice: migration cancelled")
+		}
+	}
+	return nil
+}
+
+// negotiateSeamless asks the target main channel whether it accepts a
+// seamless migration from a source running migration protocol srcVersion
+func negotiateSeamless(dst *SpiceConn, srcVersion uint32) (bool, error) {
+	if err := dst.WriteMessage(SPICE_MSGC_MAIN_MIGRATE_DST_DO_SEAMLESS, srcVersion); err != nil {
+		return false, err
+	}
+
+	cnx, _ := dst.current()
+	cnx.SetReadDeadline(time.Now().Add(migrateTimeout))
+	defer cnx.SetReadDeadline(time.Time{})
+
+	var res uint16
+	for res == 0 {
+		err := dst.ReadData(func(typ uint16, data []byte) error {
+			switch typ {
+			case SPICE_MSG_MAIN_MIGRATE_DST_SEAMLESS_ACK, SPICE_MSG_MAIN_MIGRATE_DST_SEAMLESS_NACK:
+				res = typ
+				return nil
+			}
+			// handle ack/ping, other messages are not expected yet
+			return dst.process(typ, data)
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return res == SPICE_MSG_MAIN_MIGRATE_DST_SEAMLESS_ACK, nil
+}
+
+// add registers the target connection for a source channel, and returns
+// false if the migration is no longer current
+func (mig *migration) add(client *Client, src, dst *SpiceConn) bool {
+	client.migLk.Lock()
+	defer client.migLk.Unlock()
+
+	if client.migration != mig {
+		dst.Close()
+		return false
+	}
+	mig.conns[src] = dst
+	return true
+}
+
+// close drops all connections to the target not in use yet
+func (mig *migration) close() {
+	for src, dst := range mig.conns {
+		if !mig.switched[src] {
+			dst.Close()
+		}
+	}
+}
+
+// migrateCancel aborts the migration in progress
+func (client *Client) migrateCancel() {
+	client.migLk.Lock()
+	defer client.migLk.Unlock()
+
+	if mig := client.migration; mig != nil {
+		mig.close()
+		client.migration = nil
+	}
+}
+
+// migrateEnd completes a semi-seamless migration: all channels are switched
+// to the target, which will then initialize them again
+func (client *Client) migrateEnd() {
+	client.migLk.Lock()
+	mig := client.migration
+	client.migration = nil
+	client.migLk.Unlock()
+
+	if mig == nil || !mig.ready {
+		log.Printf("spice: got MIGRATE_END without migration in progress")
+		if mig != nil {
+			mig.close()
+		}
+		return
+	}
+
+	client.setConnector(mig.c)
+	main := client.main.conn
+
+	// the target starts with empty caches
+	client.pixmaps.clear()
+	client.glz.clear()
+
+	for src, dst := range mig.conns {
+		if src != main {
+			src.switchTo(dst)
+		}
+	}
+	main.switchTo(mig.conns[main])
+	main.WriteMessage(SPICE_MSGC_MAIN_MIGRATE_END)
+
+	client.migrateFinish(mig)
+}
+
+// migrateChannel handles SPICE_MSG_MIGRATE during a seamless migration
+func (client *Client) migrateChannel(c *SpiceConn, flags uint32) {
+	client.migLk.Lock()
+	mig := client.migration
+	client.migLk.Unlock()
+
+	if mig == nil || !mig.ready || mig.conns[c] == nil || mig.switched[c] {
+		log.Printf("spice: %s got SPICE_MSG_MIGRATE without migration in progress", c.String())
+		return
+	}
+
+	if flags&SPICE_MIGRATE_NEED_FLUSH != 0 {
+		c.WriteMessage(SPICE_MSGC_MIGRATE_FLUSH_MARK)
+	}
+	if flags&SPICE_MIGRATE_NEED_DATA_TRANSFER != 0 {
+		// switch once SPICE_MSG_MIGRATE_DATA is received
+		client.migLk.Lock()
+		mig.waitData[c] = true
+		client.migLk.Unlock()
+		return
+	}
+	client.migrateSwitch(mig, c, nil)
+}
+
+// migrateData forwards the state of a channel to the target and switches to it
+func (client *Client) migrateData(c *SpiceConn, data []byte) {
+	client.migLk.Lock()
+	mig := client.migration
+	wait := mig != nil && mig.waitData[c]
+	client.migLk.Unlock()
+
+	if !wait {
+		log.Printf("spice: %s got unexpected SPICE_MSG_MIGRATE_DATA", c.String())
+		return
+	}
+	client.migrateSwitch(mig, c, data)
+}
+
+// migrateSwitch switches a single channel to the target, sending data as
+// SPICE_MSGC_MIGRATE_DATA first if not nil
+func (client *Client) migrateSwitch(mig *migration, c *SpiceConn, data []byte) {
+	client.migLk.Lock()
+	dst := mig.conns[c]
+	delete(mig.waitData, c)
+	mig.switched[c] = true
+	remain := len(mig.conns) - len(mig.switched)
+	if remain == 0 && client.migration == mig {
+		client.migration = nil
+	}
+	client.migLk.Unlock()
+	if data != nil {
+		if err := dst.WriteMessage(SPICE_MSGC_MIGRATE_DATA, data); err != nil {
+			log.Printf("spice: %s failed to send migration data: %s", c.String(), err)
+		}
+	}
+	c.switchTo(dst)
+	log.Printf("spice: %s switched to migration target", c.String())
+
+	if remain == 0 {
+		client.setConnector(mig.c)
+		client.migrateFinish(mig)
+	}
+}
+
+// migrateFinish closes channels that could not be migrated
+func (client *Client) migrateFinish(mig *migration) {
+	client.connsLk.Lock()
+	var stale []*SpiceConn
+	for c := range client.conns {
+		if _, ok := mig.conns[c]; !ok {
+			stale = append(stale, c)
+		}
+	}
+	client.connsLk.Unlock()
+
+	log.Printf("spice: migration to %s completed", mig.dst)
+	client.emit(Migrated{Target: mig.dst})
+
+	for _, c := range stale {
+		c.Close()
+	}
+}
+
+var errSwitchHost = errors.New("spice: server requested switching host")
+
+// switchHost handles SPICE_MSG_MAIN_MIGRATE_SWITCH_HOST, sent by servers not
+// supporting semi-seamless migration: a new session is established with the
+// target
+func (client *Client) switchHost(dst MigrationTarget) {
+	c, err := client.migrationConnector(dst)
+	if err != nil {
+		log.Printf("spice: cannot switch to %s: %s", dst, err)
+		return
+	}
+	client.setConnector(c)
+	client.reconnectSession(errSwitchHost)
+}
@@ -0,0 +1,89 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMigrationTarget(t *testing.T) {
+	host := "dst.example.com\x00"
+	subject := "C=IL,CN=dst\x00"
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, []uint16{5900, 0xffff})
+	binary.Write(buf, binary.LittleEndian, []uint32{uint32(len(host)), 20, uint32(len(subject)), 20 + uint32(len(host))})
+	buf.WriteString(host)
+	buf.WriteString(subject)
+
+	dst, err := parseMigrationTarget(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, MigrationTarget{Host: "dst.example.com", Port: 5900, HostSubject: "C=IL,CN=dst"}, dst)
+
+	// out of bounds host pointer
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[8:12], 1000)
+	_, err = parseMigrationTarget(data)
+	assert.NotNil(t, err)
+
+	_, err = parseMigrationTarget(data[:10])
+	assert.NotNil(t, err)
+}
+
+func TestTLSConnectorMigrate(t *testing.T) {
+	src := &TLSConnector{Addr: "src:5900", TLSAddr: "src:5901", ServerName: "src", HostSubject: "CN=src"}
+
+	c, err := src.SpiceMigrate(MigrationTarget{Host: "dst", TLSPort: 5901, HostSubject: "CN=dst"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	dst := c.(*TLSConnector)
+	assert.Equal(t, "", dst.Addr)
+	assert.Equal(t, "dst:5901", dst.TLSAddr)
+	assert.Equal(t, "", dst.ServerName)
+	assert.Equal(t, "CN=dst", dst.HostSubject)
+	assert.Equal(t, ChannelModeSecure, dst.SpiceChannelMode(ChannelMain))
+
+	_, err = src.SpiceMigrate(MigrationTarget{Host: "dst"})
+	assert.NotNil(t, err)
+}
+
+func TestClientSemiSeamlessMigration(t *testing.T) {
+	src, dst := newTestServer(t), newTestServer(t)
+	src.next = dst
+
+	cl, err := New(src, testDriver{}, "password")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer cl.Close()
+
+	host := "dst\x00"
+	begin := &bytes.Buffer{}
+	binary.Write(begin, binary.LittleEndian, []uint16{5900, 0xffff})
+	binary.Write(begin, binary.LittleEndian, []uint32{uint32(len(host)), 20, 0, 0})
+	begin.WriteString(host)
+
+	src.send(SPICE_MSG_MAIN_MIGRATE_BEGIN, begin.Bytes())
+	src.waitRecv(t, SPICE_MSGC_MAIN_MIGRATE_CONNECTED)
+
+	src.send(SPICE_MSG_MAIN_MIGRATE_END, nil)
+	dst.waitRecv(t, SPICE_MSGC_MAIN_MIGRATE_END)
+	// target initializes the main channel again
+	dst.waitRecv(t, SPICE_MSGC_MAIN_ATTACH_CHANNELS)
+
+	var migrated bool
+	for !migrated {
+		select {
+		case ev := <-cl.Events():
+			_, migrated = ev.(Migrated)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no Migrated event")
+		}
+	}
+	assert.Nil(t, cl.Err())
+	assert.Equal(t, dst, cl.connector())
+}
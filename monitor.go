@@ -0,0 +1,169 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"sort"
+)
+
+// VD_AGENT_MONITORS_CONFIG flags
+const (
+	VD_AGENT_CONFIG_MONITORS_FLAG_USE_POS = 1
+)
+
+// MonitorDriver is an optional interface for drivers able to handle multiple
+// displays. When the driver implements it, all display and cursor channels
+// are connected and the Monitor* methods are called instead of DisplayInit,
+// DisplayRefresh and SetCursor.
+//
+// A display is identified by the id of its display channel. Windows guests
+// use one display channel per monitor, while Linux guests may show several
+// monitors as regions of a single display, as described by MonitorsConfig.
+type MonitorDriver interface {
+	Driver
+
+	// MonitorInit is called when the primary surface of a display is created
+	MonitorInit(display uint8, img image.Image)
+	// MonitorRefresh is called when the image of a display was updated
+	MonitorRefresh(display uint8)
+	// MonitorCursor updates the cursor shown on a display, img is nil to hide it
+	MonitorCursor(display uint8, img image.Image, x, y uint16)
+	// MonitorsConfig is called when the server reports the monitors shown
+	// by a display, an empty list meaning the display is disabled
+	MonitorsConfig(display uint8, mons []DisplayMonitor)
+}
+
+// DisplayMonitor describes a monitor (head) as reported by the server, the
+// area of the display surface it shows
+type DisplayMonitor struct {
+	Display uint8  // display channel id
+	ID      uint32 // monitor id within the display channel
+	Surface uint32 // id of the surface shown
+	X, Y    uint32 // position within the surface
+	Width   uint32
+	Height  uint32
+	Flags   uint32
+}
+
+// Rectangle returns the area of the surface shown by the monitor
+func (m DisplayMonitor) Rectangle() image.Rectangle {
+	return image.Rect(int(m.X), int(m.Y), int(m.X+m.Width), int(m.Y+m.Height))
+}
+
+// parseMonitorsConfig parses SPICE_MSG_DISPLAY_MONITORS_CONFIG
+func parseMonitorsConfig(display uint8, data []byte) ([]DisplayMonitor, error) {
+	if len(data) < 4 {
+		return nil, errors.New("spice/display: monitors config too short")
+	}
+	cnt := int(binary.LittleEndian.Uint16(data[:2]))
+	// data[2:4] is the maximum number of monitors allowed
+
+	if len(data) < 4+(cnt*28) {
+		return nil, errors.New("spice/display: monitors config too short")
+	}
+
+	res := make([]DisplayMonitor, cnt)
+	for i := range res {
+		info := data[4+(i*28) : 4+((i+1)*28)]
+		res[i] = DisplayMonitor{
+			Display: display,
+			ID:      binary.LittleEndian.Uint32(info[:4]),
+			Surface: binary.LittleEndian.Uint32(info[4:8]),
+			Width:   binary.LittleEndian.Uint32(info[8:12]),
+			Height:  binary.LittleEndian.Uint32(info[12:16]),
+			X:       binary.LittleEndian.Uint32(info[16:20]),
+			Y:       binary.LittleEndian.Uint32(info[20:24]),
+			Flags:   binary.LittleEndian.Uint32(info[24:28]),
+		}
+	}
+	return res, nil
+}
+
+// multiMonitor returns the driver if it supports multiple displays
+func (client *Client) multiMonitor() (MonitorDriver, bool) {
+	md, ok := client.driver.(MonitorDriver)
+	return md, ok
+}
+
+func (client *Client) displayInit(display uint8, img image.Image) {
+	if rec := client.recording(display); rec != nil {
+		if rgba, ok := img.(*image.RGBA); ok {
+			rec.display(rgba)
+		}
+	}
+	if md, ok := client.multiMonitor(); ok {
+		md.MonitorInit(display, img)
+	} else if display == 0 {
+		client.driver.DisplayInit(img)
+	}
+}
+
+func (client *Client) displayRefresh(display uint8) {
+	if md, ok := client.multiMonitor(); ok {
+		md.MonitorRefresh(display)
+	} else if display == 0 {
+		client.driver.DisplayRefresh()
+	}
+}
+
+func (client *Client) setCursor(display uint8, img image.Image, x, y uint16) {
+	if md, ok := client.multiMonitor(); ok {
+		md.MonitorCursor(display, img, x, y)
+	} else if display == 0 {
+		client.driver.SetCursor(img, x, y)
+	}
+}
+
+// setMonitors records the monitors of a display and informs the driver
+func (client *Client) setMonitors(display uint8, mons []DisplayMonitor) {
+	client.stateLk.Lock()
+	if client.heads == nil {
+		client.heads = make(map[uint8][]DisplayMonitor)
+	}
+	client.heads[display] = mons
+	client.stateLk.Unlock()
+
+	if md, ok := client.multiMonitor(); ok {
+		md.MonitorsConfig(display, mons)
+	}
+}
+
+// Monitors returns the monitors currently reported by the server, for all
+// displays
+func (client *Client) Monitors() []DisplayMonitor {
+	client.stateLk.Lock()
+	defer client.stateLk.Unlock()
+
+	var res []DisplayMonitor
+	for _, mons := range client.heads {
+		res = append(res, mons...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Display != res[j].Display {
+			return res[i].Display < res[j].Display
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// UpdateViews asks the guest agent to configure one monitor per entry, for
+// example when the client windows are resized. Positions are only applied if
+// at least one monitor has a non zero position, otherwise the guest arranges
+// monitors itself.
+func (client *Client) UpdateViews(mons []SpiceMonitor) error {
+	m := client.main
+	if m == nil {
+		return errors.New("spice: main channel not available")
+	}
+
+	var flags uint32
+	for _, mon := range mons {
+		if mon.X != 0 || mon.Y != 0 {
+			flags |= VD_AGENT_CONFIG_MONITORS_FLAG_USE_POS
+			break
+		}
+	}
+	return m.MonitorConfig(flags, mons)
+}
@@ -0,0 +1,30 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMonitorsConfig(t *testing.T) {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, []uint16{2, 4})
+	binary.Write(buf, binary.LittleEndian, []uint32{0, 0, 1024, 768, 0, 0, 0})
+	binary.Write(buf, binary.LittleEndian, []uint32{1, 0, 800, 600, 1024, 0, 0})
+
+	mons, err := parseMonitorsConfig(1, buf.Bytes())
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, []DisplayMonitor{
+		{Display: 1, ID: 0, Width: 1024, Height: 768},
+		{Display: 1, ID: 1, X: 1024, Width: 800, Height: 600},
+	}, mons)
+	assert.Equal(t, image.Rect(1024, 0, 1824, 600), mons[1].Rectangle())
+
+	_, err = parseMonitorsConfig(0, buf.Bytes()[:40])
+	assert.NotNil(t, err)
+}
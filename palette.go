@@ -0,0 +1,67 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+)
+
+// flags of bitmap and LZ_PLT images
+const (
+	SPICE_BITMAP_FLAGS_PAL_CACHE_ME   = 1
+	SPICE_BITMAP_FLAGS_PAL_FROM_CACHE = 2
+	SPICE_BITMAP_FLAGS_TOP_DOWN       = 4
+)
+
+// parsePalette reads a SpicePalette: uint64 unique, uint16 num_ents, then
+// num_ents xRGB colors
+func parsePalette(msg []byte, ptr uint32) (uint64, []color.RGBA, error) {
+	if ptr == 0 || uint64(ptr)+10 > uint64(len(msg)) {
+		return 0, nil, errors.New("invalid palette pointer")
+	}
+	buf := msg[ptr:]
+	id := binary.LittleEndian.Uint64(buf[:8])
+	n := int(binary.LittleEndian.Uint16(buf[8:10]))
+	if len(buf) < 10+n*4 {
+		return 0, nil, errors.New("palette too short")
+	}
+
+	pal := make([]color.RGBA, n)
+	for i := range pal {
+		v := binary.LittleEndian.Uint32(buf[10+i*4:])
+		pal[i] = color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+	}
+	return id, pal, nil
+}
+
+// palette returns the palette of a bitmap or LZ_PLT image, given the image
+// flags and the palette reference (a pointer in msg, or a cached palette id)
+func (d *SpiceDisplay) palette(msg []byte, flags uint8, ref []byte) ([]color.RGBA, error) {
+	if flags&SPICE_BITMAP_FLAGS_PAL_FROM_CACHE != 0 {
+		if len(ref) < 8 {
+			return nil, errors.New("palette id missing")
+		}
+		id := binary.LittleEndian.Uint64(ref[:8])
+		pal, ok := d.palettes[id]
+		if !ok {
+			return nil, fmt.Errorf("palette %d not in cache", id)
+		}
+		return pal, nil
+	}
+
+	if len(ref) < 4 {
+		return nil, errors.New("palette pointer missing")
+	}
+	id, pal, err := parsePalette(msg, binary.LittleEndian.Uint32(ref[:4]))
+	if err != nil {
+		return nil, err
+	}
+	if flags&SPICE_BITMAP_FLAGS_PAL_CACHE_ME != 0 {
+		if d.palettes == nil {
+			d.palettes = make(map[uint64][]color.RGBA)
+		}
+		d.palettes[id] = pal
+	}
+	return pal, nil
+}
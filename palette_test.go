@@ -0,0 +1,60 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPalette = []uint32{0x000000, 0x102030}
+
+// testLzPlt8 builds a top down 2x1 PLT8 LZ image with pixels 1, 0
+func testLzPlt8() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("  ZL")
+	binary.Write(buf, binary.BigEndian, []uint32{0x00010001, uint32(LZ_IMAGE_TYPE_PLT8), 2, 1, 2, 1})
+	buf.Write([]byte{0x01, 1, 0})
+	return buf.Bytes()
+}
+
+func TestLzPltImage(t *testing.T) {
+	d := newTestDisplay()
+	lz := testLzPlt8()
+
+	// palette sent with the image and cached
+	m := (&testMsg{}).put(uint32(0))
+	m.put(uint64(1), uint8(SPICE_IMAGE_TYPE_LZ_PLT), uint8(0), uint32(2), uint32(1))
+	palPtr := uint32(m.Len() + 9 + len(lz))
+	m.put(uint8(SPICE_BITMAP_FLAGS_PAL_CACHE_ME), uint32(len(lz)), palPtr)
+	m.Write(lz)
+	m.put(uint64(7), uint16(len(testPalette)), testPalette)
+
+	img, err := d.decodeImage(m.Bytes(), 4)
+	if !assert.Nil(t, err) {
+		return
+	}
+	rgba := img.Image.(*image.RGBA)
+	assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, rgba.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, rgba.RGBAAt(1, 0))
+	assert.Len(t, d.palettes, 1)
+
+	// palette from the cache
+	m = (&testMsg{}).put(uint32(0))
+	m.put(uint64(2), uint8(SPICE_IMAGE_TYPE_LZ_PLT), uint8(0), uint32(2), uint32(1))
+	m.put(uint8(SPICE_BITMAP_FLAGS_PAL_FROM_CACHE), uint32(len(lz)), uint64(7))
+	m.Write(lz)
+
+	img, err = d.decodeImage(m.Bytes(), 4)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, color.RGBA{0x10, 0x20, 0x30, 0xff}, img.Image.(*image.RGBA).RGBAAt(0, 0))
+
+	d.handle(SPICE_MSG_DISPLAY_INVAL_PALETTE, (&testMsg{}).put(uint64(7)).Bytes())
+	_, err = d.decodeImage(m.Bytes(), 4)
+	assert.NotNil(t, err)
+}
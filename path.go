@@ -0,0 +1,230 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+)
+
+// path segment flags
+const (
+	SPICE_PATH_BEGIN  = 1 << 0
+	SPICE_PATH_END    = 1 << 1
+	SPICE_PATH_CLOSE  = 1 << 3
+	SPICE_PATH_BEZIER = 1 << 4
+)
+
+// line attribute flags
+const (
+	SPICE_LINE_FLAGS_START_WITH_GAP = 1 << 2
+	SPICE_LINE_FLAGS_STYLED         = 1 << 3
+)
+
+// PointFix is a point in 28.4 fixed point coordinates
+type PointFix struct {
+	X int32
+	Y int32
+}
+
+func (p PointFix) float() (float64, float64) {
+	return float64(p.X) / 16, float64(p.Y) / 16
+}
+
+type PathSeg struct {
+	Flags  uint8 // 1=BEGIN 2=END 8=CLOSE 16=BEZIER
+	Points []PointFix
+}
+
+// parsePath reads a SpicePath: uint32 num_segments, then pointers to
+// segments made of uint8 flags, uint32 count and count points
+func parsePath(msg []byte, ptr uint32) ([]PathSeg, error) {
+	if ptr == 0 || uint64(ptr)+4 > uint64(len(msg)) {
+		return nil, errors.New("invalid path pointer")
+	}
+	n := binary.LittleEndian.Uint32(msg[ptr:])
+	if uint64(ptr)+4+uint64(n)*4 > uint64(len(msg)) {
+		return nil, errors.New("path too short")
+	}
+
+	segs := make([]PathSeg, n)
+	for i := range segs {
+		sp := uint64(binary.LittleEndian.Uint32(msg[ptr+4+uint32(i)*4:]))
+		if sp == 0 || sp+5 > uint64(len(msg)) {
+			return nil, fmt.Errorf("invalid path segment %d", i)
+		}
+		count := uint64(binary.LittleEndian.Uint32(msg[sp+1:]))
+		if sp+5+count*8 > uint64(len(msg)) {
+			return nil, fmt.Errorf("path segment %d too short", i)
+		}
+
+		segs[i].Flags = msg[sp]
+		segs[i].Points = make([]PointFix, count)
+		for j := range segs[i].Points {
+			o := sp + 5 + uint64(j)*8
+			segs[i].Points[j] = PointFix{X: int32(binary.LittleEndian.Uint32(msg[o:])), Y: int32(binary.LittleEndian.Uint32(msg[o+4:]))}
+		}
+	}
+	return segs, nil
+}
+
+// LineAttr describes how a path is stroked. Lines are always one pixel wide.
+type LineAttr struct {
+	Flags uint8   // 4=START_WITH_GAP 8=STYLED
+	Style []int32 // lengths of dashes and gaps in 28.4 fixed point, if STYLED
+}
+
+// flattenPath converts path segments to polylines, one per sub path, with
+// bezier curves approximated by lines
+func flattenPath(segs []PathSeg) [][]image.Point {
+	var polys [][]image.Point
+	var cur []image.Point
+	var start, last [2]float64
+
+	add := func(x, y float64) {
+		p := image.Pt(int(math.Floor(x+0.5)), int(math.Floor(y+0.5)))
+		if len(cur) == 0 || cur[len(cur)-1] != p {
+			cur = append(cur, p)
+		}
+		last = [2]float64{x, y}
+	}
+
+	for _, seg := range segs {
+		pts := seg.Points
+		if seg.Flags&SPICE_PATH_BEGIN != 0 && len(pts) > 0 {
+			if len(cur) > 0 {
+				polys = append(polys, cur)
+			}
+			cur = nil
+			x, y := pts[0].float()
+			start = [2]float64{x, y}
+			add(x, y)
+			pts = pts[1:]
+		}
+
+		if seg.Flags&SPICE_PATH_BEZIER != 0 {
+			// cubic curves, 3 points each
+			for ; len(pts) >= 3; pts = pts[3:] {
+				x0, y0 := last[0], last[1]
+				x1, y1 := pts[0].float()
+				x2, y2 := pts[1].float()
+				x3, y3 := pts[2].float()
+				steps := int(math.Hypot(x3-x0, y3-y0)+math.Hypot(x1-x0, y1-y0)+math.Hypot(x2-x1, y2-y1)) / 4
+				if steps < 4 {
+					steps = 4
+				} else if steps > 64 {
+					steps = 64
+				}
+				for i := 1; i <= steps; i++ {
+					t := float64(i) / float64(steps)
+					u := 1 - t
+					add(u*u*u*x0+3*u*u*t*x1+3*u*t*t*x2+t*t*t*x3, u*u*u*y0+3*u*u*t*y1+3*u*t*t*y2+t*t*t*y3)
+				}
+			}
+		} else {
+			for _, p := range pts {
+				add(p.float())
+			}
+		}
+
+		if seg.Flags&SPICE_PATH_END != 0 {
+			if seg.Flags&SPICE_PATH_CLOSE != 0 && len(cur) > 1 {
+				add(start[0], start[1])
+			}
+			if len(cur) > 0 {
+				polys = append(polys, cur)
+			}
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		polys = append(polys, cur)
+	}
+	return polys
+}
+
+// strokePixels calls plot for each pixel of the polylines, with Bresenham
+// lines. Pixels shared by consecutive lines are only plotted once, so XOR
+// strokes do not leave holes at joints. Styled lines skip the gaps.
+func strokePixels(polys [][]image.Point, attr LineAttr, plot func(x, y int)) {
+	// style lengths in pixels
+	var style []float64
+	if attr.Flags&SPICE_LINE_FLAGS_STYLED != 0 {
+		for _, v := range attr.Style {
+			if v > 0 {
+				style = append(style, float64(v)/16)
+			}
+		}
+	}
+
+	for _, poly := range polys {
+		si, left := 0, 0.0
+		on := attr.Flags&SPICE_LINE_FLAGS_START_WITH_GAP == 0
+		if len(style) > 0 {
+			left = style[0]
+		}
+		step := func(x, y int) {
+			if len(style) == 0 {
+				plot(x, y)
+				return
+			}
+			if on {
+				plot(x, y)
+			}
+			left--
+			for left <= 0 {
+				si = (si + 1) % len(style)
+				left += style[si]
+				on = !on
+			}
+		}
+
+		closed := len(poly) > 2 && poly[0] == poly[len(poly)-1]
+		if len(poly) == 1 {
+			step(poly[0].X, poly[0].Y)
+		}
+		for i := 1; i < len(poly); i++ {
+			// skip the first pixel of lines continuing the polyline, and
+			// the last pixel of the line closing it
+			skipLast := closed && i == len(poly)-1
+			bresenham(poly[i-1], poly[i], i > 1, skipLast, step)
+		}
+	}
+}
+
+func bresenham(p0, p1 image.Point, skipFirst, skipLast bool, plot func(x, y int)) {
+	dx, dy := p1.X-p0.X, -(p1.Y - p0.Y)
+	sx, sy := 1, 1
+	if dx < 0 {
+		dx = -dx
+		sx = -1
+	}
+	if dy > 0 {
+		dy = -dy
+	}
+	if p0.Y > p1.Y {
+		sy = -1
+	}
+
+	x, y := p0.X, p0.Y
+	e := dx + dy
+	for first := true; ; first = false {
+		last := x == p1.X && y == p1.Y
+		if !(first && skipFirst) && !(last && skipLast) {
+			plot(x, y)
+		}
+		if last {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y += sy
+		}
+	}
+}
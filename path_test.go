@@ -0,0 +1,57 @@
+package spice
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fix(x, y int32) PointFix {
+	return PointFix{X: x * 16, Y: y * 16}
+}
+
+func TestStrokePixels(t *testing.T) {
+	// closed triangle, each pixel plotted once
+	polys := flattenPath([]PathSeg{
+		{Flags: SPICE_PATH_BEGIN, Points: []PointFix{fix(0, 0), fix(4, 0)}},
+		{Flags: SPICE_PATH_END | SPICE_PATH_CLOSE, Points: []PointFix{fix(4, 4)}},
+	})
+	assert.Equal(t, [][]image.Point{{{0, 0}, {4, 0}, {4, 4}, {0, 0}}}, polys)
+
+	seen := map[image.Point]int{}
+	strokePixels(polys, LineAttr{}, func(x, y int) { seen[image.Pt(x, y)]++ })
+	for p, n := range seen {
+		assert.Equal(t, 1, n, "pixel %v", p)
+	}
+	assert.Len(t, seen, 12)
+
+	// dashes of 2 pixels
+	var xs []int
+	strokePixels([][]image.Point{{{0, 0}, {7, 0}}}, LineAttr{Flags: SPICE_LINE_FLAGS_STYLED, Style: []int32{32, 32}}, func(x, y int) { xs = append(xs, x) })
+	assert.Equal(t, []int{0, 1, 4, 5}, xs)
+
+	// bezier curves end on their last point
+	polys = flattenPath([]PathSeg{{Flags: SPICE_PATH_BEGIN | SPICE_PATH_END | SPICE_PATH_BEZIER, Points: []PointFix{fix(0, 0), fix(0, 8), fix(8, 8), fix(8, 0)}}})
+	assert.Equal(t, image.Pt(8, 0), polys[0][len(polys[0])-1])
+}
+
+func TestDrawStroke(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 8, 8, true)
+
+	// path with a single horizontal line, pointed to from the message
+	m := (&testMsg{}).base(0, Rect{Top: 0, Left: 0, Bottom: 8, Right: 8})
+	pathPtr := uint32(m.Len() + 4 + 1 + 5 + 4)
+	m.put(pathPtr, uint8(0), uint8(SPICE_BRUSH_TYPE_SOLID), uint32(0xffffff), SpiceRopdOpPut, Ropd(0))
+	m.put(uint32(1), pathPtr+8)
+	m.put(uint8(SPICE_PATH_BEGIN|SPICE_PATH_END), uint32(2), fix(1, 2), fix(5, 2))
+	d.handle(SPICE_MSG_DISPLAY_DRAW_STROKE, m.Bytes())
+
+	for x := 1; x <= 5; x++ {
+		assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, d.surfaces[0].img.RGBAAt(x, 2))
+	}
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(6, 2))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, d.surfaces[0].img.RGBAAt(1, 3))
+}
@@ -64,13 +64,26 @@ type DisplayBase struct {
 func (res *DisplayBase) Decode(r *bytes.Reader) error {
 	binary.Read(r, binary.LittleEndian, &res.Surface)
 	res.Box.Decode(r)
-	binary.Read(r, binary.LittleEndian, &res.ClipType)
+	return res.decodeClip(r)
+}
+
+// decodeClip reads the Clip of a DisplayBase, also sent alone by the stream
+// messages: uint8 clip_type, then if clip_type=1 uint32 num_rects and rects
+func (res *DisplayBase) decodeClip(r *bytes.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &res.ClipType); err != nil {
+		return err
+	}
 
 	switch res.ClipType {
 	case 0:
+		res.NumRects = 0
+		res.Rects = nil
 		return nil
 	case 1:
 		binary.Read(r, binary.LittleEndian, &res.NumRects)
+		if uint64(res.NumRects)*16 > uint64(r.Len()) {
+			return errors.New("invalid display base clip")
+		}
 
 		res.Rects = make([]Rect, res.NumRects)
 		for i := uint32(0); i < res.NumRects; i++ {
@@ -81,3 +94,53 @@ func (res *DisplayBase) Decode(r *bytes.Reader) error {
 		return errors.New("invalid display base")
 	}
 }
+
+const (
+	SPICE_BRUSH_TYPE_NONE = iota
+	SPICE_BRUSH_TYPE_SOLID
+	SPICE_BRUSH_TYPE_PATTERN
+)
+
+type Brush struct {
+	Type     uint8  // 0=NONE 1=SOLID 2=PATTERN
+	Color    uint32 // xRGB, if type=1
+	ImagePtr uint32 // pattern image, if type=2
+	Pos      Point  // pattern origin, if type=2
+}
+
+func (brush *Brush) Decode(r *bytes.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &brush.Type); err != nil {
+		return err
+	}
+
+	switch brush.Type {
+	case SPICE_BRUSH_TYPE_NONE:
+		return nil
+	case SPICE_BRUSH_TYPE_SOLID:
+		return binary.Read(r, binary.LittleEndian, &brush.Color)
+	case SPICE_BRUSH_TYPE_PATTERN:
+		binary.Read(r, binary.LittleEndian, &brush.ImagePtr)
+		return brush.Pos.Decode(r)
+	default:
+		return errors.New("invalid brush")
+	}
+}
+
+type Point16 struct {
+	X int16
+	Y int16
+}
+
+func (point *Point16) Decode(r *bytes.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &point.X); err != nil {
+		return err
+	}
+	return binary.Read(r, binary.LittleEndian, &point.Y)
+}
+
+// Transform is a pixman style 3x2 affine transform, in 16.16 fixed point
+type Transform [6]int32
+
+func (tr *Transform) Decode(r *bytes.Reader) error {
+	return binary.Read(r, binary.LittleEndian, tr)
+}
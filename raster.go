@@ -0,0 +1,243 @@
+package spice
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// xrgb converts a SPICE xRGB color to an opaque color
+func xrgb(c uint32) color.RGBA {
+	return color.RGBA{R: uint8(c >> 16), G: uint8(c >> 8), B: uint8(c), A: 0xff}
+}
+
+// rgbaAt returns the pixel of img at x, y
+func rgbaAt(img image.Image, x, y int) color.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba.RGBAAt(x, y)
+	}
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+// rop applies the raster operation on a color component. srcInvers and
+// dstInvers are the flags inverting each operand, as a ropd can combine the
+// source image, the brush or the destination.
+func (op Ropd) rop(src, dst byte, srcInvers, dstInvers Ropd) byte {
+	if op&srcInvers != 0 {
+		src = ^src
+	}
+	if op&dstInvers != 0 {
+		dst = ^dst
+	}
+
+	var res byte
+	switch {
+	case op&SpiceRopdOpPut != 0:
+		res = src
+	case op&SpiceRopdOpOr != 0:
+		res = src | dst
+	case op&SpiceRopdOpAnd != 0:
+		res = src & dst
+	case op&SpiceRopdOpXor != 0:
+		res = src ^ dst
+	case op&SpiceRopdOpBlackness != 0:
+		res = 0
+	case op&SpiceRopdOpWhiteness != 0:
+		res = 0xff
+	case op&SpiceRopdOpInvers != 0:
+		res = ^dst
+	default:
+		res = dst
+	}
+
+	if op&SpiceRopdInversRes != 0 {
+		res = ^res
+	}
+	return res
+}
+
+// ropPixel applies the raster operation on the color components of p,
+// keeping its alpha unless the source is put as is
+func (op Ropd) ropPixel(p []byte, src color.RGBA, srcInvers, dstInvers Ropd) {
+	p[0] = op.rop(src.R, p[0], srcInvers, dstInvers)
+	p[1] = op.rop(src.G, p[1], srcInvers, dstInvers)
+	p[2] = op.rop(src.B, p[2], srcInvers, dstInvers)
+	if op&SpiceRopdOpPut != 0 {
+		p[3] = src.A
+	}
+}
+
+// rop3 applies a ternary raster operation on brush, source and destination
+// bits: bit (p<<2 | s<<1 | d) of code is the result for these input bits.
+func rop3(code, p, s, d byte) byte {
+	var res byte
+	for i := uint(0); i < 8; i++ {
+		if code&(1<<i) == 0 {
+			continue
+		}
+		t := byte(0xff)
+		if i&4 != 0 {
+			t &= p
+		} else {
+			t &= ^p
+		}
+		if i&2 != 0 {
+			t &= s
+		} else {
+			t &= ^s
+		}
+		if i&1 != 0 {
+			t &= d
+		} else {
+			t &= ^d
+		}
+		res |= t
+	}
+	return res
+}
+
+// pixman compositing operators used by DRAW_COMPOSITE
+const (
+	compositeOpClear = iota
+	compositeOpSrc
+	compositeOpDst
+	compositeOpOver
+	compositeOpOverReverse
+	compositeOpIn
+	compositeOpInReverse
+	compositeOpOut
+	compositeOpOutReverse
+	compositeOpAtop
+	compositeOpAtopReverse
+	compositeOpXor
+	compositeOpAdd
+	compositeOpSaturate
+)
+
+// composite combines premultiplied src with the pixel p using a Porter-Duff
+// operator. It returns false for unsupported operators.
+func composite(op uint8, p []byte, src color.RGBA) bool {
+	sa, da := int(src.A), int(p[3])
+
+	// fraction of source and destination kept, out of 255
+	var fa, fb int
+	switch op {
+	case compositeOpClear:
+		fa, fb = 0, 0
+	case compositeOpSrc:
+		fa, fb = 255, 0
+	case compositeOpDst:
+		fa, fb = 0, 255
+	case compositeOpOver:
+		fa, fb = 255, 255-sa
+	case compositeOpOverReverse:
+		fa, fb = 255-da, 255
+	case compositeOpIn:
+		fa, fb = da, 0
+	case compositeOpInReverse:
+		fa, fb = 0, sa
+	case compositeOpOut:
+		fa, fb = 255-da, 0
+	case compositeOpOutReverse:
+		fa, fb = 0, 255-sa
+	case compositeOpAtop:
+		fa, fb = da, 255-sa
+	case compositeOpAtopReverse:
+		fa, fb = 255-da, sa
+	case compositeOpXor:
+		fa, fb = 255-da, 255-sa
+	case compositeOpAdd:
+		fa, fb = 255, 255
+	case compositeOpSaturate:
+		fa, fb = 255, 255
+		if sa > 255-da {
+			fa = (255 - da) * 255 / sa
+		}
+	default:
+		return false
+	}
+
+	s := [4]int{int(src.R), int(src.G), int(src.B), sa}
+	for i := range s {
+		v := (s[i]*fa + int(p[i])*fb + 127) / 255
+		if v > 255 {
+			v = 255
+		}
+		p[i] = byte(v)
+	}
+	return true
+}
+
+// pixman repeat modes
+const (
+	compositeRepeatNone = iota
+	compositeRepeatNormal
+	compositeRepeatPad
+	compositeRepeatReflect
+)
+
+// compositeSource samples an image for DRAW_COMPOSITE, applying its
+// transform (nearest filter) and repeat mode
+type compositeSource struct {
+	img       image.Image
+	transform *Transform
+	repeat    int
+	origin    image.Point
+}
+
+// at returns the sample for the destination pixel at x, y relative to the
+// drawing box
+func (c *compositeSource) at(x, y int) color.RGBA {
+	sx, sy := c.origin.X+x, c.origin.Y+y
+	if t := c.transform; t != nil {
+		// transform the pixel center
+		fx, fy := float64(sx)+0.5, float64(sy)+0.5
+		tx := (float64(t[0])*fx + float64(t[1])*fy + float64(t[2])) / 65536
+		ty := (float64(t[3])*fx + float64(t[4])*fy + float64(t[5])) / 65536
+		sx, sy = int(math.Floor(tx)), int(math.Floor(ty))
+	}
+
+	b := c.img.Bounds()
+	var ok bool
+	if sx, ok = repeatCoord(sx, b.Min.X, b.Max.X, c.repeat); !ok {
+		return color.RGBA{}
+	}
+	if sy, ok = repeatCoord(sy, b.Min.Y, b.Max.Y, c.repeat); !ok {
+		return color.RGBA{}
+	}
+	return rgbaAt(c.img, sx, sy)
+}
+
+func repeatCoord(v, min, max, repeat int) (int, bool) {
+	n := max - min
+	if n <= 0 {
+		return 0, false
+	}
+	switch repeat {
+	case compositeRepeatNormal:
+		v = (v-min)%n + min
+		if v < min {
+			v += n
+		}
+	case compositeRepeatPad:
+		if v < min {
+			v = min
+		} else if v >= max {
+			v = max - 1
+		}
+	case compositeRepeatReflect:
+		v = (v - min) % (2 * n)
+		if v < 0 {
+			v += 2 * n
+		}
+		if v >= n {
+			v = 2*n - 1 - v
+		}
+		v += min
+	default:
+		if v < min || v >= max {
+			return 0, false
+		}
+	}
+	return v, true
+}
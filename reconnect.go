@@ -0,0 +1,142 @@
+package spice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ReconnectPolicy controls how a Client re-establishes lost connections
+type ReconnectPolicy struct {
+	MaxAttempts    int           // maximum number of attempts per failure, 0 for unlimited
+	InitialBackoff time.Duration // delay before the second attempt, defaults to 500ms
+	MaxBackoff     time.Duration // maximum delay between attempts, defaults to 30s
+	Multiplier     float64       // backoff growth factor, defaults to 2
+}
+
+// WithReconnect enables automatic reconnection. When the main channel is lost
+// a new session is established and all channels are linked again, restoring
+// the mouse mode, agent state and monitor configuration. Other channels are
+// re-linked individually to the current session. The session only ends once
+// the policy gives up.
+func WithReconnect(p ReconnectPolicy) Option {
+	return func(cl *Client) {
+		cl.reconnect = &p
+	}
+}
+
+var errReconnectAbort = errors.New("spice: reconnection no longer needed")
+
+// retry calls fn until it succeeds, the policy gives up or the client is closed
+func (client *Client) retry(what string, fn func() error) error {
+	p := client.reconnect
+	if p == nil {
+		// reconnection disabled, try once
+		p = &ReconnectPolicy{MaxAttempts: 1}
+	}
+
+	delay := p.InitialBackoff
+	if delay <= 0 {
+		delay = 500 * time.Millisecond
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	mul := p.Multiplier
+	if mul < 1 {
+		mul = 2
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || errors.Is(err, errReconnectAbort) {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return err
+		}
+		log.Printf("spice: reconnecting %s failed (attempt %d): %s, retrying in %s", what, attempt, err, delay)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-client.ctx.Done():
+			t.Stop()
+			return client.Err()
+		}
+
+		delay = time.Duration(float64(delay) * mul)
+		if delay > max {
+			delay = max
+		}
+	}
+}
+
+// reconnectSession establishes a new session after the main channel was lost
+func (client *Client) reconnectSession(cause error) {
+	client.connsLk.Lock()
+	if client.conns == nil {
+		// closed
+		client.connsLk.Unlock()
+		return
+	}
+	client.gen++
+	client.connecting = true
+	conns := client.conns
+	client.conns = make(map[*SpiceConn]struct{})
+	client.connsLk.Unlock()
+
+	// other channels belong to the lost session
+	for c := range conns {
+		c.Close()
+	}
+
+	log.Printf("spice: main channel lost (%s), reconnecting", cause)
+	client.emit(Reconnecting{Err: cause})
+
+	// the new session starts with empty caches
+	client.pixmaps.clear()
+	client.glz.clear()
+
+	err := client.retry("session", func() error {
+		// a new session id will be assigned by the server
+		client.setSession(0)
+		return client.setupMain()
+	})
+
+	client.connsLk.Lock()
+	client.connecting = false
+	client.connsLk.Unlock()
+
+	if err != nil {
+		client.shutdown(fmt.Errorf("spice: main channel lost: %w (reconnection failed: %s)", cause, err))
+		return
+	}
+
+	client.setupChannels()
+	session := client.sessionID()
+	log.Printf("spice: session %d re-established", session)
+	client.emit(Reconnected{Session: session})
+}
+
+// reconnectChannel links a lost channel again, unless the session it belonged
+// to has been replaced in the meantime
+func (client *Client) reconnectChannel(ch SpiceChannelInfo, gen uint32) {
+	err := client.retry(fmt.Sprintf("channel %s[%d]", ch.typ, ch.id), func() error {
+		client.connsLk.Lock()
+		current := client.gen
+		client.connsLk.Unlock()
+
+		if current != gen {
+			return errReconnectAbort
+		}
+		return client.setupChannel(ch)
+	})
+
+	if err != nil && !errors.Is(err, errReconnectAbort) {
+		log.Printf("spice: giving up on channel %s[%d]: %s", ch.typ, ch.id, err)
+		client.emit(ChannelFailed{Channel: ch.typ, ID: ch.id, Err: err})
+	}
+}
@@ -0,0 +1,254 @@
+package spice
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// audio format of recordings, the one used by SPICE servers
+	recordChannels = 2
+	recordFreq     = 48000
+)
+
+// Recorder records the first display and the audio playback of a session
+// to an AVI file, with MJPEG video and 16 bits PCM audio. Frames and audio
+// are placed using the media time of the session.
+type Recorder struct {
+	cl  *Client
+	fps int
+
+	lk      sync.Mutex
+	avi     *aviWriter
+	err     error       // first write error, recording stops
+	src     *image.RGBA // primary surface, only read with the display locked
+	fb      *image.RGBA // copy of the display, of the size of the video
+	dirty   bool        // fb changed since the last frame was encoded
+	jpg     []byte      // last frame encoded
+	start   uint32      // media time of the first frame
+	samples int64       // audio samples written
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Record starts recording the first display and the audio playback to w,
+// at fps frames per second. The video has the size of the display when
+// recording starts; later resolution changes are cropped or padded. Audio
+// other than 48kHz stereo is not recorded. The file is complete once
+// Close is called.
+func (client *Client) Record(w io.WriteSeeker, fps int) (*Recorder, error) {
+	if fps <= 0 {
+		return nil, errors.New("spice: invalid recording frame rate")
+	}
+
+	client.recLk.Lock()
+	d := client.screen
+	busy := client.recorder != nil
+	client.recLk.Unlock()
+	if busy {
+		return nil, errors.New("spice: already recording")
+	}
+	if d == nil {
+		return nil, errors.New("spice: display not initialized")
+	}
+
+	// lock order is display, then recorder
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.primary == nil {
+		return nil, errors.New("spice: display not initialized")
+	}
+	src := d.primary.img
+
+	avi, err := newAVIWriter(w, src.Rect.Dx(), src.Rect.Dy(), fps, recordChannels, recordFreq)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		cl:    client,
+		fps:   fps,
+		avi:   avi,
+		src:   src,
+		fb:    image.NewRGBA(src.Rect),
+		dirty: true,
+		start: client.MediaTime(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	copy(r.fb.Pix, src.Pix)
+
+	client.recLk.Lock()
+	if client.recorder != nil {
+		client.recLk.Unlock()
+		return nil, errors.New("spice: already recording")
+	}
+	client.recorder = r
+	client.recLk.Unlock()
+
+	go r.run()
+	return r, nil
+}
+
+// Close stops the recording and completes the file. It returns the first
+// error met while recording.
+func (r *Recorder) Close() error {
+	r.cl.recLk.Lock()
+	if r.cl.recorder == r {
+		r.cl.recorder = nil
+	}
+	r.cl.recLk.Unlock()
+
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.done
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.avi != nil {
+		if err := r.avi.close(); err != nil && r.err == nil {
+			r.err = err
+		}
+		r.avi = nil
+	}
+	return r.err
+}
+
+// recording returns the recorder following a display, if any
+func (client *Client) recording(display uint8) *Recorder {
+	if display != 0 {
+		return nil
+	}
+	client.recLk.Lock()
+	defer client.recLk.Unlock()
+	return client.recorder
+}
+
+// display is called with the display locked when its primary surface is
+// replaced
+func (r *Recorder) display(img *image.RGBA) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.src = img
+	draw.Draw(r.fb, r.fb.Rect, image.Black, image.Point{}, draw.Src)
+	draw.Draw(r.fb, r.fb.Rect, img, image.Point{}, draw.Src)
+	r.dirty = true
+}
+
+// damage is called with the display locked when rects of the primary
+// surface changed
+func (r *Recorder) damage(rects []image.Rectangle) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	for _, c := range rects {
+		c = c.Intersect(r.fb.Rect).Intersect(r.src.Rect)
+		if !c.Empty() {
+			draw.Draw(r.fb, c, r.src, c.Min, draw.Src)
+			r.dirty = true
+		}
+	}
+}
+
+// audio adds PCM samples played at mm time t
+func (r *Recorder) audio(t uint32, channels, freq int, pcm []int16) {
+	if channels != recordChannels || freq != recordFreq {
+		return
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.err != nil || r.avi == nil {
+		return
+	}
+
+	// skip samples from before the recording, and fill gaps with silence.
+	// Overlapping audio is appended as is.
+	at := int64(int32(t-r.start)) * recordFreq / 1000
+	if at < 0 {
+		skip := -at * recordChannels
+		if skip >= int64(len(pcm)) {
+			return
+		}
+		pcm, at = pcm[skip:], 0
+	}
+	if gap := at - r.samples; gap > recordFreq/50 {
+		r.write(r.avi.writeAudio(make([]int16, gap*recordChannels)))
+		r.samples = at
+	}
+	r.write(r.avi.writeAudio(pcm))
+	r.samples += int64(len(pcm) / recordChannels)
+}
+
+// write records the first error met, with r.lk held
+func (r *Recorder) write(err error) {
+	if err != nil && r.err == nil {
+		log.Printf("spice: recording stopped: %s", err)
+		r.err = err
+	}
+}
+
+// run writes video frames at the recording frame rate
+func (r *Recorder) run() {
+	defer close(r.done)
+	t := time.NewTicker(time.Second / time.Duration(r.fps))
+	defer t.Stop()
+
+	for {
+		r.frame()
+		select {
+		case <-t.C:
+		case <-r.stop:
+			return
+		case <-r.cl.done:
+			return
+		}
+	}
+}
+
+// frame writes the frames due at the current media time, encoding the
+// display if it changed
+func (r *Recorder) frame() {
+	r.lk.Lock()
+	var img *image.RGBA
+	if r.dirty {
+		img = image.NewRGBA(r.fb.Rect)
+		copy(img.Pix, r.fb.Pix)
+		r.dirty = false
+	}
+	r.lk.Unlock()
+
+	var jpg []byte
+	if img != nil {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, nil); err != nil {
+			log.Printf("spice: failed to encode recorded frame: %s", err)
+		} else {
+			jpg = buf.Bytes()
+		}
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if jpg != nil {
+		r.jpg = jpg
+	}
+	if r.err != nil || r.avi == nil || r.jpg == nil {
+		return
+	}
+
+	// frames repeat the last image until the display changes
+	due := int64(int32(r.cl.MediaTime()-r.start))*int64(r.fps)/1000 + 1
+	for int64(r.avi.frames) < due && r.err == nil {
+		r.write(r.avi.writeFrame(r.jpg))
+	}
+}
@@ -0,0 +1,84 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	d := newTestDisplay()
+	d.cl.mmTime, d.cl.mmStamp = 5000, time.Now()
+	d.cl.screen = d
+
+	_, err := d.cl.Record(nil, 25)
+	assert.EqualError(t, err, "spice: display not initialized")
+
+	d.createSurface(0, 16, 8, true)
+	d.handle(SPICE_MSG_DISPLAY_MARK, nil)
+
+	name := filepath.Join(t.TempDir(), "rec.avi")
+	f, err := os.Create(name)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	rec, err := d.cl.Record(f, 25)
+	assert.NoError(t, err)
+	_, err = d.cl.Record(f, 25)
+	assert.EqualError(t, err, "spice: already recording")
+
+	time.Sleep(50 * time.Millisecond)
+	d.fill(0, Rect{Top: 0, Left: 0, Bottom: 8, Right: 16}, 0xffffffff, SpiceRopdOpPut)
+
+	// 100ms of raw audio, starting 50ms after the recording
+	p := &ChPlayback{cl: d.cl, mode: SPICE_AUDIO_DATA_MODE_RAW, channels: 2, freq: 48000}
+	pcm := make([]byte, 4800*2*2)
+	p.handle(SPICE_MSG_PLAYBACK_DATA, append((&testMsg{}).put(d.cl.MediaTime()).Bytes(), pcm...))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, rec.Close())
+	assert.Nil(t, d.cl.recorder)
+
+	data, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, "RIFF", string(data[:4]))
+	assert.Equal(t, uint32(len(data)-8), binary.LittleEndian.Uint32(data[4:8]))
+	assert.Equal(t, "AVI ", string(data[8:12]))
+
+	// walk the index
+	idx := bytes.Index(data, []byte("idx1"))
+	movi := bytes.Index(data, []byte("movi"))
+	assert.True(t, idx > movi && movi > 0)
+	var frames []byte
+	var nframes, samples int
+	entries := data[idx+8:]
+	for ; len(entries) >= 16; entries = entries[16:] {
+		ofs := movi + int(binary.LittleEndian.Uint32(entries[8:12]))
+		size := int(binary.LittleEndian.Uint32(entries[12:16]))
+		assert.Equal(t, string(entries[:4]), string(data[ofs:ofs+4]))
+		switch string(entries[:4]) {
+		case "00dc":
+			nframes++
+			frames = data[ofs+8 : ofs+8+size]
+		case "01wb":
+			samples += size / 4
+		}
+	}
+	assert.True(t, nframes >= 3 && nframes <= 10, "%d frames", nframes)
+	assert.Equal(t, uint32(nframes), binary.LittleEndian.Uint32(data[48:52])) // avih total frames
+	// audio starts with silence until the samples played
+	assert.True(t, samples >= 4800+2400-480 && samples <= 4800+4800, "%d samples", samples)
+
+	// the last frame shows the fill
+	img, err := jpeg.Decode(bytes.NewReader(frames))
+	assert.NoError(t, err)
+	r, g, b, _ := img.At(8, 4).RGBA()
+	assert.Equal(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff})
+}
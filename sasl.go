@@ -0,0 +1,383 @@
+package spice
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// SASLMechanism describes a SASL authentication mechanism. Since each channel
+// authenticates separately, a new SASLClient is created for each exchange.
+type SASLMechanism interface {
+	// Name returns the IANA registered name of the mechanism, ie. "PLAIN"
+	Name() string
+	// NewClient creates the client side state for one authentication exchange
+	NewClient() (SASLClient, error)
+}
+
+// SASLClient performs the client side of a SASL exchange
+type SASLClient interface {
+	// Start returns the initial response, or nil if the mechanism has none
+	Start() ([]byte, error)
+	// Next returns the response to the given server challenge
+	Next(challenge []byte) ([]byte, error)
+}
+
+// SASLPlain implements the PLAIN mechanism (RFC 4616). Since the password is
+// sent as is, it should only be used over TLS.
+type SASLPlain struct {
+	Identity string // authorization identity, usually empty
+	Username string
+	Password string
+}
+
+func (m SASLPlain) Name() string {
+	return "PLAIN"
+}
+
+func (m SASLPlain) NewClient() (SASLClient, error) {
+	return &saslPlainClient{m}, nil
+}
+
+type saslPlainClient struct {
+	SASLPlain
+}
+
+func (c *saslPlainClient) Start() ([]byte, error) {
+	return []byte(c.Identity + "\x00" + c.Username + "\x00" + c.Password), nil
+}
+
+func (c *saslPlainClient) Next(challenge []byte) ([]byte, error) {
+	if len(challenge) > 0 {
+		return nil, errors.New("sasl: unexpected challenge for PLAIN")
+	}
+	return nil, nil
+}
+
+// SASLScramSHA256 implements the SCRAM-SHA-256 mechanism (RFC 7677), which
+// does not expose the password to the server. The server signature is checked.
+type SASLScramSHA256 struct {
+	Username string
+	Password string
+}
+
+func (m SASLScramSHA256) Name() string {
+	return "SCRAM-SHA-256"
+}
+
+func (m SASLScramSHA256) NewClient() (SASLClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &saslScramClient{
+		user:   m.Username,
+		pass:   m.Password,
+		h:      sha256.New,
+		cnonce: base64.RawStdEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+type saslScramClient struct {
+	user, pass string
+	h          func() hash.Hash
+	cnonce     string
+	step       int
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (c *saslScramClient) Start() ([]byte, error) {
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.user)
+	c.clientFirstBare = "n=" + user + ",r=" + c.cnonce
+	c.step = 1
+	return []byte("n,," + c.clientFirstBare), nil
+}
+
+func (c *saslScramClient) Next(challenge []byte) ([]byte, error) {
+	switch c.step {
+	case 1:
+		c.step = 2
+		return c.clientFinal(string(challenge))
+	case 2:
+		c.step = 3
+		attrs := scramAttrs(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, fmt.Errorf("sasl: server error: %s", e)
+		}
+		v, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil {
+			return nil, fmt.Errorf("sasl: invalid server signature: %w", err)
+		}
+		if !hmac.Equal(v, c.serverSignature) {
+			return nil, errors.New("sasl: server signature mismatch")
+		}
+		return nil, nil
+	default:
+		return nil, errors.New("sasl: unexpected challenge for SCRAM")
+	}
+}
+
+func (c *saslScramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttrs(serverFirst)
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.cnonce) || len(nonce) == len(c.cnonce) {
+		return nil, errors.New("sasl: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("sasl: invalid salt: %w", err)
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 {
+		return nil, errors.New("sasl: invalid iteration count")
+	}
+
+	final := "c=biws,r=" + nonce // biws = base64("n,,")
+	authMsg := c.clientFirstBare + "," + serverFirst + "," + final
+
+	salted := pbkdf2(c.h, []byte(c.pass), salt, iter)
+	clientKey := hmacSum(c.h, salted, []byte("Client Key"))
+	storedKey := c.h()
+	storedKey.Write(clientKey)
+	clientSig := hmacSum(c.h, storedKey.Sum(nil), []byte(authMsg))
+
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+
+	serverKey := hmacSum(c.h, salted, []byte("Server Key"))
+	c.serverSignature = hmacSum(c.h, serverKey, []byte(authMsg))
+
+	return []byte(final + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func scramAttrs(s string) map[string]string {
+	res := make(map[string]string)
+	for _, a := range strings.Split(s, ",") {
+		if len(a) > 2 && a[1] == '=' {
+			res[a[:1]] = a[2:]
+		}
+	}
+	return res
+}
+
+func hmacSum(h func() hash.Hash, key, data []byte) []byte {
+	m := hmac.New(h, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// pbkdf2 computes a single block PBKDF2 key as used by SCRAM (RFC 2898)
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	m := hmac.New(h, password)
+	m.Write(salt)
+	m.Write([]byte{0, 0, 0, 1})
+	u := m.Sum(nil)
+	res := append([]byte(nil), u...)
+
+	for n := 1; n < iter; n++ {
+		m.Reset()
+		m.Write(u)
+		u = m.Sum(u[:0])
+		for i := range res {
+			res[i] ^= u[i]
+		}
+	}
+	return res
+}
+
+// GSSAPIContext is implemented by external Kerberos/GSSAPI libraries to be
+// used through SASLGSSAPI
+type GSSAPIContext interface {
+	// InitSecContext processes the token received from the server (nil on first
+	// call) and returns the token to send along with whether the security
+	// context is now established
+	InitSecContext(token []byte) (out []byte, established bool, err error)
+	// Wrap protects a message using the established context
+	Wrap(data []byte) ([]byte, error)
+	// Unwrap verifies and extracts a message protected by the server
+	Unwrap(data []byte) ([]byte, error)
+}
+
+// SASLGSSAPI implements the GSSAPI mechanism (RFC 4752) on top of an
+// externally provided GSSAPI implementation. Only the "no security layer"
+// option is negotiated, so it is best used together with TLS.
+type SASLGSSAPI struct {
+	NewContext func() (GSSAPIContext, error) // creates a context for the SPICE service principal
+	AuthzID    string                        // authorization identity, usually empty
+}
+
+func (m SASLGSSAPI) Name() string {
+	return "GSSAPI"
+}
+
+func (m SASLGSSAPI) NewClient() (SASLClient, error) {
+	if m.NewContext == nil {
+		return nil, errors.New("sasl: no GSSAPI context provider")
+	}
+	ctx, err := m.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	return &saslGSSAPIClient{ctx: ctx, authz: m.AuthzID}, nil
+}
+
+type saslGSSAPIClient struct {
+	ctx         GSSAPIContext
+	authz       string
+	established bool
+}
+
+func (c *saslGSSAPIClient) Start() ([]byte, error) {
+	out, est, err := c.ctx.InitSecContext(nil)
+	c.established = est
+	return out, err
+}
+
+func (c *saslGSSAPIClient) Next(challenge []byte) ([]byte, error) {
+	if !c.established {
+		out, est, err := c.ctx.InitSecContext(challenge)
+		if err != nil {
+			return nil, err
+		}
+		c.established = est
+		if out == nil {
+			out = []byte{}
+		}
+		return out, nil
+	}
+
+	// security layer negotiation: 1 byte bitmask of layers + 3 bytes max buffer size
+	data, err := c.ctx.Unwrap(challenge)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 4 {
+		return nil, errors.New("sasl: invalid GSSAPI security layer message")
+	}
+	if data[0]&1 == 0 {
+		return nil, errors.New("sasl: server requires a GSSAPI security layer")
+	}
+	return c.ctx.Wrap(append([]byte{1, 0, 0, 0}, c.authz...))
+}
+
+// authSASL performs the SASL authentication exchange once SASL has been
+// selected as auth mechanism
+func (c *SpiceConn) authSASL() error {
+	var ln uint32
+	if err := binary.Read(c.conn, binary.LittleEndian, &ln); err != nil {
+		return err
+	}
+	if ln > 4096 {
+		return errors.New("sasl: mechanism list too large")
+	}
+	buf := make([]byte, ln)
+	if err := c.ReadFull(buf); err != nil {
+		return err
+	}
+	serverMechs := strings.FieldsFunc(string(bytes.TrimRight(buf, "\x00")), func(r rune) bool { return r == ',' || r == ' ' })
+
+	var mech SASLMechanism
+	for _, m := range c.client.sasl {
+		for _, name := range serverMechs {
+			if m.Name() == name {
+				mech = m
+				break
+			}
+		}
+		if mech != nil {
+			break
+		}
+	}
+	if mech == nil {
+		return fmt.Errorf("sasl: no common mechanism, server supports %v", serverMechs)
+	}
+	log.Printf("spice: %s authenticating using SASL mechanism %s", c.String(), mech.Name())
+
+	cl, err := mech.NewClient()
+	if err != nil {
+		return err
+	}
+	out, err := cl.Start()
+	if err != nil {
+		return err
+	}
+
+	name := mech.Name()
+	pkt := &bytes.Buffer{}
+	binary.Write(pkt, binary.LittleEndian, uint32(len(name)))
+	pkt.WriteString(name)
+	writeSASLData(pkt, out)
+	if _, err := pkt.WriteTo(c.conn); err != nil {
+		return err
+	}
+
+	for {
+		// server step: uint32 len, data (NUL terminated), uint8 complete
+		if err := binary.Read(c.conn, binary.LittleEndian, &ln); err != nil {
+			return err
+		}
+		if ln > 64*1024 {
+			return errors.New("sasl: server data too large")
+		}
+		in := make([]byte, ln)
+		if err := c.ReadFull(in); err != nil {
+			return err
+		}
+		if ln > 0 {
+			// remove NUL terminator
+			in = in[:ln-1]
+		}
+		var complete uint8
+		if err := binary.Read(c.conn, binary.LittleEndian, &complete); err != nil {
+			return err
+		}
+
+		if complete != 0 {
+			if len(in) > 0 {
+				// allow the mechanism to verify the server's final message
+				if _, err := cl.Next(in); err != nil {
+					return err
+				}
+			}
+			break
+		}
+
+		out, err = cl.Next(in)
+		if err != nil {
+			return err
+		}
+		pkt.Reset()
+		writeSASLData(pkt, out)
+		if _, err := pkt.WriteTo(c.conn); err != nil {
+			return err
+		}
+	}
+
+	return c.ReadError()
+}
+
+// writeSASLData writes data the way SPICE expects it: NUL terminated with
+// the length including the terminator, or a zero length if there is no data
+func writeSASLData(pkt *bytes.Buffer, data []byte) {
+	if data == nil {
+		binary.Write(pkt, binary.LittleEndian, uint32(0))
+		return
+	}
+	binary.Write(pkt, binary.LittleEndian, uint32(len(data)+1))
+	pkt.Write(data)
+	pkt.WriteByte(0)
+}
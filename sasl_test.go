@@ -0,0 +1,40 @@
+package spice
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSASLScramSHA256(t *testing.T) {
+	// test vector from RFC 7677 section 3
+	c := &saslScramClient{user: "user", pass: "pencil", h: sha256.New, cnonce: "rOprNGfwEbeRWgbNEkqO"}
+
+	out, err := c.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(out))
+
+	out, err = c.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	assert.Nil(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(out))
+
+	_, err = c.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	assert.Nil(t, err)
+}
+
+func TestSASLScramBadServerSignature(t *testing.T) {
+	c := &saslScramClient{user: "user", pass: "pencil", h: sha256.New, cnonce: "rOprNGfwEbeRWgbNEkqO"}
+	c.Start()
+	c.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+
+	_, err := c.Next([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	assert.NotNil(t, err)
+}
+
+func TestSASLPlain(t *testing.T) {
+	c, _ := SASLPlain{Username: "tim", Password: "tanstaaftanstaaf"}.NewClient()
+	out, err := c.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "\x00tim\x00tanstaaftanstaaf", string(out))
+}
@@ -0,0 +1,327 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"log"
+	"time"
+)
+
+const (
+	SPICE_STREAM_FLAGS_TOP_DOWN = 1
+
+	// frames waiting to be presented, per stream
+	streamQueueSize = 16
+
+	// audio_delay of STREAM_REPORT when unknown
+	streamReportNoAudioDelay = 0xffffffff
+)
+
+// stream is a video stream of the display channel. Frames are decoded as
+// they arrive, and drawn by a goroutine once their media time is reached.
+type stream struct {
+	d      *SpiceDisplay
+	id     uint32
+	codec  uint8
+	flags  uint8
+	base   DisplayBase  // surface, destination and clip; protected by d.lk
+	dec    VideoDecoder // nil if the codec is not supported
+	frames chan streamFrame
+	stop   chan struct{} // closed with d.lk held once destroyed
+	report streamReport  // protected by d.lk
+}
+
+// streamReport holds the statistics of the frames received since the last
+// STREAM_REPORT, used by the server to adapt the stream bitrate
+type streamReport struct {
+	active   bool
+	uniqueID uint32        // identifies the report request
+	window   uint32        // frames per report
+	timeout  time.Duration // maximum time between reports
+	started  time.Time     // reception of the first frame of the report
+
+	startMM, endMM uint32 // mm time of the first and last frames
+	frames, drops  uint32
+	delay          int32 // time left before the mm time of the last frame, once decoded
+}
+
+type streamFrame struct {
+	mmTime uint32
+	img    image.Image
+	dest   Rect
+}
+
+// handleStreamCreate handles STREAM_CREATE: uint32 surface_id, uint32 id,
+// uint8 flags, uint8 codec_type, uint64 stamp, uint32 stream_width,
+// uint32 stream_height, uint32 src_width, uint32 src_height, Rect dest,
+// Clip clip
+func (d *SpiceDisplay) handleStreamCreate(data []byte) {
+	r := bytes.NewReader(data)
+	var hdr struct {
+		Surface, ID  uint32
+		Flags, Codec uint8
+		Stamp        uint64
+		StreamW      uint32
+		StreamH      uint32
+		SrcW, SrcH   uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		log.Printf("spice/display: stream create packet too short")
+		return
+	}
+
+	s := &stream{
+		d:      d,
+		id:     hdr.ID,
+		codec:  hdr.Codec,
+		flags:  hdr.Flags,
+		frames: make(chan streamFrame, streamQueueSize),
+		stop:   make(chan struct{}),
+	}
+	s.base.Surface = hdr.Surface
+	s.base.Box.Decode(r)
+	if err := s.base.decodeClip(r); err != nil {
+		log.Printf("spice/display: stream create: %s", err)
+		return
+	}
+
+	if s.dec = d.cl.videoDecoder(hdr.Codec); s.dec == nil {
+		log.Printf("spice/display: stream %d uses unsupported codec %d", hdr.ID, hdr.Codec)
+	}
+
+	if old, ok := d.streams[hdr.ID]; ok {
+		old.close()
+	}
+	if d.streams == nil {
+		d.streams = make(map[uint32]*stream)
+	}
+	d.streams[hdr.ID] = s
+	log.Printf("spice/display: stream %d created, codec=%d %dx%d dest=%+v", hdr.ID, hdr.Codec, hdr.StreamW, hdr.StreamH, s.base.Box)
+
+	go s.run()
+}
+
+// handleStreamData handles STREAM_DATA and STREAM_DATA_SIZED: uint32 id,
+// uint32 multi_media_time, [uint32 width, uint32 height, Rect dest],
+// uint32 data_size, data
+func (d *SpiceDisplay) handleStreamData(data []byte, sized bool) {
+	r := bytes.NewReader(data)
+	var id, mmTime uint32
+	binary.Read(r, binary.LittleEndian, &id)
+	binary.Read(r, binary.LittleEndian, &mmTime)
+
+	s, ok := d.streams[id]
+	if !ok {
+		log.Printf("spice/display: data for unknown stream %d", id)
+		return
+	}
+
+	dest := s.base.Box
+	if sized {
+		var width, height uint32
+		binary.Read(r, binary.LittleEndian, &width)
+		binary.Read(r, binary.LittleEndian, &height)
+		dest.Decode(r)
+	}
+
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil || uint64(size) > uint64(r.Len()) {
+		log.Printf("spice/display: stream data packet too short")
+		return
+	}
+	frame := data[len(data)-r.Len():][:size]
+
+	dropped := !s.receive(mmTime, frame, dest)
+	s.account(mmTime, dropped)
+}
+
+// receive decodes a frame and queues it for presentation. It returns false
+// if the frame was dropped.
+func (s *stream) receive(mmTime uint32, frame []byte, dest Rect) bool {
+	if s.dec == nil {
+		return false
+	}
+	img, err := s.dec.Decode(frame)
+	if err != nil {
+		log.Printf("spice/display: stream %d: failed to decode frame: %s", s.id, err)
+		return false
+	}
+	if s.flags&SPICE_STREAM_FLAGS_TOP_DOWN == 0 {
+		img = flipImage(img)
+	}
+
+	select {
+	case s.frames <- streamFrame{mmTime: mmTime, img: img, dest: dest}:
+		return true
+	default:
+		log.Printf("spice/display: stream %d: too many frames queued, dropping frame", s.id)
+		return false
+	}
+}
+
+// handleStreamActivateReport handles STREAM_ACTIVATE_REPORT: uint32
+// stream_id, uint32 unique_id, uint32 max_window_size, uint32 timeout_ms
+func (d *SpiceDisplay) handleStreamActivateReport(data []byte) {
+	if len(data) < 16 {
+		log.Printf("spice/display: stream activate report packet too short")
+		return
+	}
+	id := binary.LittleEndian.Uint32(data[:4])
+	s, ok := d.streams[id]
+	if !ok {
+		log.Printf("spice/display: report requested for unknown stream %d", id)
+		return
+	}
+
+	s.report = streamReport{
+		active:   true,
+		uniqueID: binary.LittleEndian.Uint32(data[4:8]),
+		window:   binary.LittleEndian.Uint32(data[8:12]),
+		timeout:  time.Duration(binary.LittleEndian.Uint32(data[12:16])) * time.Millisecond,
+	}
+}
+
+// account adds a received frame to the stream report, and sends the report
+// once its window is full or its timeout expired. Frames received after
+// their mm time are counted as dropped, as they can't be shown in time.
+func (s *stream) account(mmTime uint32, dropped bool) {
+	rep := &s.report
+	if !rep.active {
+		return
+	}
+
+	delay := s.d.cl.MediaTill(mmTime) / time.Millisecond
+	if delay < 0 {
+		dropped = true
+	}
+
+	if rep.frames == 0 {
+		rep.started = time.Now()
+		rep.startMM = mmTime
+	}
+	rep.endMM = mmTime
+	rep.frames++
+	if dropped {
+		rep.drops++
+	}
+	rep.delay = int32(delay)
+
+	if rep.frames < rep.window && time.Since(rep.started) < rep.timeout {
+		return
+	}
+
+	// uint32 stream_id, uint32 unique_id, uint32 start_frame_mm_time,
+	// uint32 end_frame_mm_time, uint32 num_frames, uint32 num_drops,
+	// int32 last_frame_delay, uint32 audio_delay
+	if s.d.conn != nil {
+		s.d.conn.WriteMessage(SPICE_MSGC_DISPLAY_STREAM_REPORT, s.id, rep.uniqueID, rep.startMM, rep.endMM, rep.frames, rep.drops, rep.delay, uint32(streamReportNoAudioDelay))
+	}
+	rep.frames, rep.drops = 0, 0
+}
+
+// handleStreamClip handles STREAM_CLIP: uint32 id, Clip clip
+func (d *SpiceDisplay) handleStreamClip(data []byte) {
+	r := bytes.NewReader(data)
+	var id uint32
+	binary.Read(r, binary.LittleEndian, &id)
+
+	s, ok := d.streams[id]
+	if !ok {
+		log.Printf("spice/display: clip for unknown stream %d", id)
+		return
+	}
+	if err := s.base.decodeClip(r); err != nil {
+		log.Printf("spice/display: stream clip: %s", err)
+	}
+}
+
+func (d *SpiceDisplay) destroyStream(id uint32) {
+	if s, ok := d.streams[id]; ok {
+		delete(d.streams, id)
+		s.close()
+	}
+}
+
+// destroyStreams stops all streams, when the server asks to or once the
+// channel is closed
+func (d *SpiceDisplay) destroyStreams() {
+	for id, s := range d.streams {
+		delete(d.streams, id)
+		s.close()
+	}
+}
+
+// close stops the stream. It is called with d.lk held, so no frame of the
+// stream is drawn afterwards.
+func (s *stream) close() {
+	close(s.stop)
+}
+
+// run presents frames at their media time
+func (s *stream) run() {
+	for {
+		var f streamFrame
+		select {
+		case f = <-s.frames:
+		case <-s.stop:
+			return
+		case <-s.d.cl.done:
+			return
+		}
+
+		// frames too late are skipped if a newer one is already there. They
+		// were counted as dropped by account on arrival if already late.
+		if wait := s.d.cl.MediaTill(f.mmTime); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-s.stop:
+				t.Stop()
+				return
+			case <-s.d.cl.done:
+				t.Stop()
+				return
+			}
+		} else if len(s.frames) > 0 {
+			continue
+		}
+
+		s.d.lk.Lock()
+		select {
+		case <-s.stop:
+		default:
+			s.draw(f)
+		}
+		s.d.lk.Unlock()
+	}
+}
+
+// draw scales a frame to its destination, within the stream clip region
+func (s *stream) draw(f streamFrame) {
+	base := s.base
+	base.Box = f.dest
+	dst, area := s.d.target(&base, nil)
+	if dst == nil {
+		return
+	}
+
+	src := scaledSource(f.img, f.img.Bounds(), f.dest.Rectangle().Size(), ImageScaleModeInterpolate)
+	area.each(dst, func(x, y int, p []byte) {
+		c := src(x, y)
+		p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+	})
+	s.d.refresh(base.Surface, area.rects()...)
+}
+
+// flipImage returns img upside down
+func flipImage(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.SetRGBA(x, b.Dy()-1-y, rgbaAt(img, b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
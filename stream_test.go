@@ -0,0 +1,134 @@
+package spice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamMJPEG(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 16, 16, true)
+
+	// 4x4 stream shown at 4,4 to 12,12, clipped to its top half
+	dest := Rect{Top: 4, Left: 4, Bottom: 12, Right: 12}
+	m := (&testMsg{}).put(uint32(0), uint32(7), uint8(SPICE_STREAM_FLAGS_TOP_DOWN), uint8(SPICE_VIDEO_CODEC_TYPE_MJPEG), uint64(0))
+	m.put(uint32(4), uint32(4), uint32(4), uint32(4), dest, uint8(1), uint32(1), Rect{Top: 4, Left: 4, Bottom: 8, Right: 12})
+	d.handle(SPICE_MSG_DISPLAY_STREAM_CREATE, m.Bytes())
+	assert.Len(t, d.streams, 1)
+
+	frame := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range frame.Pix {
+		frame.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, frame, nil))
+
+	m = (&testMsg{}).put(uint32(7), uint32(0), uint32(buf.Len()), buf.Bytes())
+	d.handle(SPICE_MSG_DISPLAY_STREAM_DATA, m.Bytes())
+
+	// frames are drawn by the stream goroutine
+	pixel := func(x, y int) color.RGBA {
+		d.lk.Lock()
+		defer d.lk.Unlock()
+		return d.primary.img.RGBAAt(x, y)
+	}
+	assert.Eventually(t, func() bool { return pixel(6, 6).R > 0xf0 }, time.Second, time.Millisecond)
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, pixel(6, 10))
+	assert.Equal(t, color.RGBA{0, 0, 0, 0xff}, pixel(2, 6))
+
+	d.handle(SPICE_MSG_DISPLAY_STREAM_DESTROY, (&testMsg{}).put(uint32(7)).Bytes())
+	assert.Len(t, d.streams, 0)
+
+	// data for destroyed streams is ignored
+	d.handle(SPICE_MSG_DISPLAY_STREAM_DATA, m.Bytes())
+}
+
+func TestStreamReport(t *testing.T) {
+	d := newTestDisplay()
+	d.cl.mmTime, d.cl.mmStamp = 1000, time.Now()
+	d.createSurface(0, 16, 16, true)
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	d.conn = &SpiceConn{conn: cli, miniHeaders: true}
+	reports := make(chan []uint32)
+	go func() {
+		for {
+			var hdr struct {
+				Type uint16
+				Size uint32
+			}
+			if binary.Read(srv, binary.LittleEndian, &hdr) != nil {
+				return
+			}
+			rep := make([]uint32, hdr.Size/4)
+			binary.Read(srv, binary.LittleEndian, rep)
+			if hdr.Type == SPICE_MSGC_DISPLAY_STREAM_REPORT {
+				reports <- rep
+			}
+		}
+	}()
+
+	m := (&testMsg{}).put(uint32(0), uint32(3), uint8(SPICE_STREAM_FLAGS_TOP_DOWN), uint8(SPICE_VIDEO_CODEC_TYPE_MJPEG), uint64(0))
+	m.put(uint32(4), uint32(4), uint32(4), uint32(4), Rect{Bottom: 4, Right: 4}, uint8(0))
+	d.handle(SPICE_MSG_DISPLAY_STREAM_CREATE, m.Bytes())
+	defer d.close()
+
+	// report every 3 frames
+	d.handle(SPICE_MSG_DISPLAY_STREAM_ACTIVATE_REPORT, (&testMsg{}).put(uint32(3), uint32(42), uint32(3), uint32(60000)).Bytes())
+
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil))
+	frame := func(mm uint32, data []byte) {
+		m := (&testMsg{}).put(uint32(3), mm, uint32(len(data)), data)
+		d.handle(SPICE_MSG_DISPLAY_STREAM_DATA, m.Bytes())
+	}
+
+	// a late frame, a frame failing to decode and a frame on time
+	frame(500, buf.Bytes())
+	frame(1100, []byte("garbage"))
+	frame(60000, buf.Bytes())
+
+	rep := <-reports
+	assert.Equal(t, []uint32{3, 42, 500, 60000, 3, 2}, rep[:6])
+	assert.InDelta(t, 59000, int32(rep[6]), 1000)
+	assert.Equal(t, uint32(streamReportNoAudioDelay), rep[7])
+
+	// the next report starts from scratch
+	frame(60100, buf.Bytes())
+	frame(60200, buf.Bytes())
+	frame(60300, buf.Bytes())
+	rep = <-reports
+	assert.Equal(t, []uint32{3, 42, 60100, 60300, 3, 0}, rep[:6])
+
+	// late frames are only counted as dropped on arrival, not again when
+	// skipped for a newer frame
+	m = (&testMsg{}).put(uint32(0), uint32(4), uint8(SPICE_STREAM_FLAGS_TOP_DOWN), uint8(SPICE_VIDEO_CODEC_TYPE_MJPEG), uint64(0))
+	m.put(uint32(4), uint32(4), uint32(4), uint32(4), Rect{Bottom: 4, Right: 4}, uint8(0))
+	d.handle(SPICE_MSG_DISPLAY_STREAM_CREATE, m.Bytes())
+	d.handle(SPICE_MSG_DISPLAY_STREAM_ACTIVATE_REPORT, (&testMsg{}).put(uint32(4), uint32(43), uint32(4), uint32(60000)).Bytes())
+	s := d.streams[4]
+	data := func(mm uint32) []byte {
+		return (&testMsg{}).put(uint32(4), mm, uint32(buf.Len()), buf.Bytes()).Bytes()
+	}
+
+	// frames are queued while the stream can't draw
+	d.lk.Lock()
+	d.handleStreamData(data(500), false)
+	d.handleStreamData(data(600), false)
+	d.handleStreamData(data(60000), false)
+	d.lk.Unlock()
+	assert.Eventually(t, func() bool { return len(s.frames) == 0 }, time.Second, time.Millisecond)
+
+	d.handle(SPICE_MSG_DISPLAY_STREAM_DATA, data(60100))
+	rep = <-reports
+	assert.Equal(t, []uint32{4, 43, 500, 60100, 4, 2}, rep[:6])
+}
@@ -0,0 +1,208 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+)
+
+const (
+	SPICE_SURFACE_FLAGS_PRIMARY = 1
+
+	SPICE_SURFACE_FMT_1_A     = 1
+	SPICE_SURFACE_FMT_8_A     = 8
+	SPICE_SURFACE_FMT_16_555  = 16
+	SPICE_SURFACE_FMT_32_xRGB = 32
+	SPICE_SURFACE_FMT_16_565  = 80
+	SPICE_SURFACE_FMT_32_ARGB = 96
+)
+
+// surface is a drawing target of the display channel. The primary surface is
+// the one shown on screen, other surfaces are used by the guest as off-screen
+// buffers. All formats are stored as RGBA.
+type surface struct {
+	id      uint32
+	format  uint32
+	primary bool
+	img     *image.RGBA
+}
+
+func (d *SpiceDisplay) initSurface(sid, width, height, format, flags uint32) {
+	switch format {
+	case SPICE_SURFACE_FMT_1_A, SPICE_SURFACE_FMT_8_A, SPICE_SURFACE_FMT_16_555, SPICE_SURFACE_FMT_16_565, SPICE_SURFACE_FMT_32_xRGB, SPICE_SURFACE_FMT_32_ARGB:
+	default:
+		log.Printf("spice/display: unsupported surface format %d", format)
+		return
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	if format != SPICE_SURFACE_FMT_32_ARGB && format != SPICE_SURFACE_FMT_8_A && format != SPICE_SURFACE_FMT_1_A {
+		// surfaces without alpha are opaque black
+		for p := 3; p < len(img.Pix); p += 4 {
+			img.Pix[p] = 0xff
+		}
+	}
+
+	s := &surface{id: sid, format: format, primary: flags&SPICE_SURFACE_FLAGS_PRIMARY != 0, img: img}
+	if d.surfaces == nil {
+		d.surfaces = make(map[uint32]*surface)
+	}
+	d.surfaces[sid] = s
+
+	if s.primary {
+		d.primary = s
+		if d.marked {
+			// primary surface replaced, ie. resolution change
+			d.resetDamage()
+			d.cl.displayInit(d.id, img)
+		}
+	}
+}
+
+func (d *SpiceDisplay) destroySurface(sid uint32) {
+	s, ok := d.surfaces[sid]
+	if !ok {
+		log.Printf("spice/display: destroying unknown surface %d", sid)
+		return
+	}
+	delete(d.surfaces, sid)
+	if s == d.primary {
+		d.primary = nil
+	}
+}
+
+// surface returns the image of the given surface, or nil if it does not exist
+func (d *SpiceDisplay) surface(sid uint32) *image.RGBA {
+	if s, ok := d.surfaces[sid]; ok {
+		return s.img
+	}
+	log.Printf("spice/display: draw on unknown surface %d", sid)
+	return nil
+}
+
+// refresh tells the driver rects of the display changed if the surface
+// drawn to is the primary surface
+func (d *SpiceDisplay) refresh(sid uint32, rects ...image.Rectangle) {
+	if p := d.primary; p != nil && p.id == sid {
+		d.addDamage(rects)
+	}
+}
+
+// decodeImage decodes the image at offset ptr of a display message. Unlike
+// DecodeImage, it can resolve images referencing display channel state.
+func (d *SpiceDisplay) decodeImage(msg []byte, ptr uint32) (*Image, error) {
+	if ptr == 0 || uint64(ptr) >= uint64(len(msg)) {
+		return nil, errors.New("invalid image pointer")
+	}
+	buf := msg[ptr:]
+	if len(buf) < 18 {
+		return nil, errors.New("image header too short")
+	}
+
+	switch buf[8] {
+	case SPICE_IMAGE_TYPE_SURFACE:
+		if len(buf) < 22 {
+			return nil, errors.New("surface image too short")
+		}
+		sid := binary.LittleEndian.Uint32(buf[18:22])
+		s, ok := d.surfaces[sid]
+		if !ok {
+			return nil, fmt.Errorf("image references unknown surface %d", sid)
+		}
+		return &Image{
+			Image:  s.img,
+			ID:     binary.LittleEndian.Uint64(buf[:8]),
+			Type:   buf[8],
+			Flags:  buf[9],
+			Width:  uint32(s.img.Rect.Dx()),
+			Height: uint32(s.img.Rect.Dy()),
+		}, nil
+	case SPICE_IMAGE_TYPE_FROM_CACHE, SPICE_IMAGE_TYPE_FROM_CACHE_LOSSLESS:
+		return d.cl.pixmaps.get(binary.LittleEndian.Uint64(buf[:8]), buf[8] == SPICE_IMAGE_TYPE_FROM_CACHE_LOSSLESS)
+	}
+
+	img, err := d.decodeSessionImage(msg, buf)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		img, err = DecodeImage(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if img.Flags&(SPICE_IMAGE_FLAGS_CACHE_ME|SPICE_IMAGE_FLAGS_CACHE_REPLACE_ME) != 0 {
+		lossy := img.Type == SPICE_IMAGE_TYPE_JPEG || img.Type == SPICE_IMAGE_TYPE_JPEG_ALPHA
+		d.cl.pixmaps.put(img.ID, img, lossy)
+	}
+	return img, nil
+}
+
+// decodeSessionImage decodes images which need state from the display
+// channel: GLZ images use the dictionary shared by the display channels,
+// palette images the palette cache or a palette elsewhere in msg. It returns
+// nil for other image types.
+func (d *SpiceDisplay) decodeSessionImage(msg, buf []byte) (*Image, error) {
+	i := &Image{
+		ID:     binary.LittleEndian.Uint64(buf[:8]),
+		Type:   buf[8],
+		Flags:  buf[9],
+		Width:  binary.LittleEndian.Uint32(buf[10:14]),
+		Height: binary.LittleEndian.Uint32(buf[14:18]),
+	}
+	buf = buf[18:]
+
+	var err error
+	switch i.Type {
+	case SPICE_IMAGE_TYPE_GLZ_RGB:
+		if len(buf) < 4 {
+			return nil, errors.New("invalid data for image")
+		}
+		ln := binary.LittleEndian.Uint32(buf[:4])
+		if uint64(len(buf)) < 4+uint64(ln) {
+			return nil, errors.New("data is missing")
+		}
+		i.Image, err = d.cl.glz.glzImage(buf[4 : 4+ln])
+	case SPICE_IMAGE_TYPE_ZLIB_GLZ_RGB:
+		i.Image, err = d.cl.glz.zlibGlzImage(buf)
+	case SPICE_IMAGE_TYPE_LZ_PLT:
+		// uint8 flags, uint32 data_size, palette pointer or id, data
+		if len(buf) < 5 {
+			return nil, errors.New("invalid data for image")
+		}
+		flags := buf[0]
+		ln := binary.LittleEndian.Uint32(buf[1:5])
+		palLen := 4
+		if flags&SPICE_BITMAP_FLAGS_PAL_FROM_CACHE != 0 {
+			palLen = 8
+		}
+		if uint64(len(buf)) < 5+uint64(palLen)+uint64(ln) {
+			return nil, errors.New("data is missing")
+		}
+		pal, err := d.palette(msg, flags, buf[5:5+palLen])
+		if err != nil {
+			return nil, err
+		}
+		i.Image, err = lzImage(buf[5+palLen:5+palLen+int(ln)], pal, nil)
+		if err != nil {
+			return nil, err
+		}
+	case SPICE_IMAGE_TYPE_BITMAP:
+		if len(buf) < 18 || !BitmapImageType(buf[0]).paletted() {
+			return nil, nil
+		}
+		pal, err := d.palette(msg, buf[1], buf[14:])
+		if err != nil {
+			return nil, err
+		}
+		i.Image, err = bitmapImage(buf, pal)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
@@ -0,0 +1,102 @@
+package spice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// string flags
+const (
+	SPICE_STRING_FLAGS_RASTER_A1       = 1 << 0
+	SPICE_STRING_FLAGS_RASTER_A4       = 1 << 1
+	SPICE_STRING_FLAGS_RASTER_A8       = 1 << 2
+	SPICE_STRING_FLAGS_RASTER_TOP_DOWN = 1 << 3
+)
+
+// Glyph is a rasterized glyph of a DRAW_TEXT string, with one coverage
+// value (0-255) per pixel
+type Glyph struct {
+	RenderPos   image.Point
+	GlyphOrigin image.Point
+	Width       int
+	Height      int
+	Alpha       []byte
+}
+
+// Rectangle returns the position of the glyph on the surface
+func (g *Glyph) Rectangle() image.Rectangle {
+	min := g.RenderPos.Add(g.GlyphOrigin)
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(g.Width, g.Height))}
+}
+
+// parseString reads a SpiceString: uint16 length, uint8 flags, then pointers
+// to glyphs made of Point render_pos, Point glyph_origin, uint16 width,
+// uint16 height and the glyph raster
+func parseString(msg []byte, ptr uint32) ([]Glyph, error) {
+	if ptr == 0 || uint64(ptr)+3 > uint64(len(msg)) {
+		return nil, errors.New("invalid string pointer")
+	}
+	n := int(binary.LittleEndian.Uint16(msg[ptr:]))
+	flags := msg[ptr+2]
+	if uint64(ptr)+3+uint64(n)*4 > uint64(len(msg)) {
+		return nil, errors.New("string too short")
+	}
+
+	var bpp int
+	switch {
+	case flags&SPICE_STRING_FLAGS_RASTER_A1 != 0:
+		bpp = 1
+	case flags&SPICE_STRING_FLAGS_RASTER_A4 != 0:
+		bpp = 4
+	case flags&SPICE_STRING_FLAGS_RASTER_A8 != 0:
+		bpp = 8
+	default:
+		return nil, fmt.Errorf("unsupported string flags %d", flags)
+	}
+
+	glyphs := make([]Glyph, n)
+	for i := range glyphs {
+		gp := uint64(binary.LittleEndian.Uint32(msg[uint64(ptr)+3+uint64(i)*4:]))
+		if gp == 0 || gp+20 > uint64(len(msg)) {
+			return nil, fmt.Errorf("invalid glyph %d", i)
+		}
+		buf := msg[gp:]
+		g := &glyphs[i]
+		g.RenderPos = image.Pt(int(int32(binary.LittleEndian.Uint32(buf[0:4]))), int(int32(binary.LittleEndian.Uint32(buf[4:8]))))
+		g.GlyphOrigin = image.Pt(int(int32(binary.LittleEndian.Uint32(buf[8:12]))), int(int32(binary.LittleEndian.Uint32(buf[12:16]))))
+		g.Width = int(binary.LittleEndian.Uint16(buf[16:18]))
+		g.Height = int(binary.LittleEndian.Uint16(buf[18:20]))
+
+		stride := (g.Width*bpp + 7) / 8
+		data := buf[20:]
+		if len(data) < stride*g.Height {
+			return nil, fmt.Errorf("glyph %d too short", i)
+		}
+
+		g.Alpha = make([]byte, g.Width*g.Height)
+		for y := 0; y < g.Height; y++ {
+			row := data[y*stride:]
+			oy := y
+			if flags&SPICE_STRING_FLAGS_RASTER_TOP_DOWN == 0 {
+				oy = g.Height - 1 - y
+			}
+			for x := 0; x < g.Width; x++ {
+				var a byte
+				switch bpp {
+				case 1:
+					if row[x/8]&(0x80>>(x%8)) != 0 {
+						a = 0xff
+					}
+				case 4:
+					a = (row[x/2] >> (4 * (1 - x%2)) & 0x0f) * 0x11
+				default:
+					a = row[x]
+				}
+				g.Alpha[oy*g.Width+x] = a
+			}
+		}
+	}
+	return glyphs, nil
+}
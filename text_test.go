@@ -0,0 +1,34 @@
+package spice
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrawText(t *testing.T) {
+	d := newTestDisplay()
+	d.createSurface(0, 8, 8, true)
+
+	box := Rect{Top: 0, Left: 0, Bottom: 8, Right: 8}
+	m := (&testMsg{}).base(0, box)
+	strPtr := uint32(m.Len() + 4 + 16 + 5 + 5 + 4)
+	m.put(strPtr, Rect{Top: 0, Left: 0, Bottom: 1, Right: 8})
+	m.put(uint8(SPICE_BRUSH_TYPE_SOLID), uint32(0xffffff), uint8(SPICE_BRUSH_TYPE_SOLID), uint32(0x0000ff))
+	m.put(SpiceRopdOpPut, SpiceRopdOpPut)
+
+	// one A1 glyph of 3x2 pixels at 2,3: 101 then 010
+	m.put(uint16(1), uint8(SPICE_STRING_FLAGS_RASTER_A1|SPICE_STRING_FLAGS_RASTER_TOP_DOWN), strPtr+7)
+	m.put(int32(2), int32(4), int32(0), int32(-1), uint16(3), uint16(2), []byte{0xa0, 0x40})
+	d.handle(SPICE_MSG_DISPLAY_DRAW_TEXT, m.Bytes())
+
+	img := d.surfaces[0].img
+	white, black := color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0, 0, 0, 0xff}
+	assert.Equal(t, color.RGBA{0, 0, 0xff, 0xff}, img.RGBAAt(5, 0))
+	assert.Equal(t, white, img.RGBAAt(2, 3))
+	assert.Equal(t, black, img.RGBAAt(3, 3))
+	assert.Equal(t, white, img.RGBAAt(4, 3))
+	assert.Equal(t, white, img.RGBAAt(3, 4))
+	assert.Equal(t, black, img.RGBAAt(2, 4))
+}
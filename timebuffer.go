@@ -19,7 +19,9 @@ type timeBuffer struct {
 	lk   sync.Mutex
 	frag []timeBufferFragment
 	ping chan struct{}
-	pos  int // position in output buffer
+	stop chan struct{} // closed to stop the runner
+	done chan struct{} // closed once the runner has stopped
+	pos  int           // position in output buffer
 }
 
 func NewTimeBuffer(cl *Client, d *ChPlayback) *timeBuffer {
@@ -27,11 +29,20 @@ func NewTimeBuffer(cl *Client, d *ChPlayback) *timeBuffer {
 		cl:   cl,
 		play: d,
 		ping: make(chan struct{}),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
 	}
 	go b.runner()
 	return b
 }
 
+// Close stops the runner and waits for it to return, after which the
+// playback stream is no longer used
+func (b *timeBuffer) Close() {
+	close(b.stop)
+	<-b.done
+}
+
 func (b *timeBuffer) Append(mmtime uint32, buf []int16) error {
 	b.lk.Lock()
 	defer b.lk.Unlock()
@@ -112,20 +123,20 @@ func (b *timeBuffer) release(t *time.Timer) {
 }
 
 func (b *timeBuffer) runner() {
+	defer close(b.done)
 	t := time.NewTimer(5 * time.Second)
+	defer t.Stop()
 
 	for {
 		b.release(t)
 
-		if t == nil {
-			<-b.ping // cause refresh
-		} else {
-			select {
-			case <-b.ping:
-			// cause refresh
-			case <-t.C:
-				// the time has come
-			}
+		select {
+		case <-b.ping:
+		// cause refresh
+		case <-t.C:
+			// the time has come
+		case <-b.stop:
+			return
 		}
 	}
 }
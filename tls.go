@@ -0,0 +1,280 @@
+package spice
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ChannelMode defines how a given channel is allowed to connect, similar to
+// libvirt's secure-channels / plaintext-channels settings
+type ChannelMode uint8
+
+const (
+	// ChannelModeAny connects in plain text and retries over TLS if the server requires it
+	ChannelModeAny ChannelMode = iota
+	// ChannelModeSecure always connects over TLS
+	ChannelModeSecure
+	// ChannelModeInsecure always connects in plain text
+	ChannelModeInsecure
+)
+
+func (m ChannelMode) String() string {
+	switch m {
+	case ChannelModeAny:
+		return "any"
+	case ChannelModeSecure:
+		return "secure"
+	case ChannelModeInsecure:
+		return "insecure"
+	default:
+		return fmt.Sprintf("ChannelMode(%d)", m)
+	}
+}
+
+// SecureConnector is an optional interface for connectors able to establish
+// TLS protected connections. When the server answers a link request with
+// ErrSpiceLinkNeedSecured (or ErrSpiceLinkNeedUnsecured) the client will
+// retry the channel using the other kind of connection, unless the channel
+// mode forbids it.
+type SecureConnector interface {
+	Connector
+	// SpiceConnectSecure establishes a TLS connection to the SPICE server
+	SpiceConnectSecure(compress bool) (net.Conn, error)
+	// SpiceChannelMode returns the connection policy for the given channel
+	SpiceChannelMode(typ Channel) ChannelMode
+}
+
+// TLSConnector is a ready to use SecureConnector connecting to a SPICE
+// server over TCP, with TLS support for servers configured with tls-port.
+type TLSConnector struct {
+	Addr    string // plain text address (host:port), leave empty if the server only has a tls-port
+	TLSAddr string // TLS address (host:port)
+
+	ServerName  string         // name sent as SNI and used for certificate validation, defaults to the host of TLSAddr
+	RootCAs     *x509.CertPool // CA bundle used to verify the server, system pool if nil
+	HostSubject string         // if set, expected certificate subject (ie. "C=IL,L=Raanana,O=Red Hat,CN=my server") instead of hostname check
+	PubKey      []byte         // if set, expected server public key (DER encoded SubjectPublicKeyInfo), disables CA checks
+
+	DefaultMode ChannelMode             // mode for channels not listed in Channels
+	Channels    map[Channel]ChannelMode // per channel mode
+
+	// Dial is used to establish the underlying TCP connections, net.Dial if nil
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// LoadCAFile reads a PEM encoded CA bundle such as the ca-cert.pem file
+// used by QEMU's spice configuration
+func LoadCAFile(fn string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("spice: no certificate found in %s", fn)
+	}
+	return pool, nil
+}
+
+func (t *TLSConnector) dial(addr string) (net.Conn, error) {
+	if t.Dial != nil {
+		return t.Dial("tcp", addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// SpiceConnect establishes a plain text connection, or a TLS connection if
+// no plain text address was configured
+func (t *TLSConnector) SpiceConnect(compress bool) (net.Conn, error) {
+	if t.Addr == "" {
+		return t.SpiceConnectSecure(compress)
+	}
+	return t.dial(t.Addr)
+}
+
+// SpiceConnectSecure establishes a TLS connection to TLSAddr
+func (t *TLSConnector) SpiceConnectSecure(compress bool) (net.Conn, error) {
+	if t.TLSAddr == "" {
+		return nil, errors.New("spice: no TLS address configured")
+	}
+	cfg, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := t.dial(t.TLSAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, cfg)
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SpiceChannelMode returns the mode configured for the given channel
+func (t *TLSConnector) SpiceChannelMode(typ Channel) ChannelMode {
+	if t.Addr == "" {
+		// no choice
+		return ChannelModeSecure
+	}
+	if t.TLSAddr == "" {
+		return ChannelModeInsecure
+	}
+	if m, ok := t.Channels[typ]; ok {
+		return m
+	}
+	return t.DefaultMode
+}
+
+func (t *TLSConnector) tlsConfig() (*tls.Config, error) {
+	serverName := t.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(t.TLSAddr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	var subject []pkix.AttributeTypeAndValue
+	if t.HostSubject != "" {
+		var err error
+		subject, err = parseHostSubject(t.HostSubject)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+		// verification is performed in VerifyConnection so we can handle
+		// subject & public key pinning the same way other SPICE clients do
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("spice: server did not present a certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+
+			if t.PubKey != nil {
+				if !bytes.Equal(leaf.RawSubjectPublicKeyInfo, t.PubKey) {
+					return errors.New("spice: server public key does not match")
+				}
+				return nil
+			}
+
+			opts := x509.VerifyOptions{Roots: t.RootCAs, Intermediates: x509.NewCertPool()}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			if subject == nil {
+				opts.DNSName = serverName
+			}
+			if _, err := leaf.Verify(opts); err != nil {
+				return err
+			}
+
+			if subject != nil && !matchSubject(leaf.Subject.Names, subject) {
+				return fmt.Errorf("spice: certificate subject %q does not match %q", leaf.Subject.String(), t.HostSubject)
+			}
+			return nil
+		},
+	}
+	return cfg, nil
+}
+
+var subjectOIDs = map[string]asn1.ObjectIdentifier{
+	"C":            {2, 5, 4, 6},
+	"ST":           {2, 5, 4, 8},
+	"L":            {2, 5, 4, 7},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"CN":           {2, 5, 4, 3},
+	"STREET":       {2, 5, 4, 9},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"EMAILADDRESS": {1, 2, 840, 113549, 1, 9, 1},
+}
+
+// parseHostSubject parses a subject in the format used by remote-viewer's
+// host-subject option: comma separated key=value pairs, with "\," and "\\"
+// used to escape values
+func parseHostSubject(s string) ([]pkix.AttributeTypeAndValue, error) {
+	var res []pkix.AttributeTypeAndValue
+	var cur strings.Builder
+	var parts []string
+
+	escape := false
+	for _, c := range s {
+		switch {
+		case escape:
+			cur.WriteRune(c)
+			escape = false
+		case c == '\\':
+			escape = true
+		case c == ',':
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	parts = append(parts, cur.String())
+
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pos := strings.IndexByte(p, '=')
+		if pos <= 0 {
+			return nil, fmt.Errorf("spice: invalid host subject entry %q", p)
+		}
+		key := strings.ToUpper(strings.TrimSpace(p[:pos]))
+		oid, ok := subjectOIDs[key]
+		if !ok {
+			return nil, fmt.Errorf("spice: unsupported host subject key %q", key)
+		}
+		res = append(res, pkix.AttributeTypeAndValue{Type: oid, Value: p[pos+1:]})
+	}
+	if len(res) == 0 {
+		return nil, errors.New("spice: empty host subject")
+	}
+	return res, nil
+}
+
+// matchSubject checks both lists contain the same attributes, regardless of order
+func matchSubject(names, expect []pkix.AttributeTypeAndValue) bool {
+	if len(names) != len(expect) {
+		return false
+	}
+	used := make([]bool, len(names))
+
+	for _, e := range expect {
+		found := false
+		for i, n := range names {
+			if used[i] || !n.Type.Equal(e.Type) {
+				continue
+			}
+			if v, ok := n.Value.(string); ok && v == e.Value {
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
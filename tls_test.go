@@ -0,0 +1,33 @@
+package spice
+
+import (
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHostSubject(t *testing.T) {
+	subj, err := parseHostSubject(`C=IL, L=Raanana,O=Red Hat\, Inc.,CN=my server`)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(subj))
+	assert.Equal(t, "Red Hat, Inc.", subj[2].Value)
+
+	name := pkix.Name{
+		Country:      []string{"IL"},
+		Locality:     []string{"Raanana"},
+		Organization: []string{"Red Hat, Inc."},
+		CommonName:   "my server",
+	}
+	// pkix.Name.Names is only populated when parsing, build it from the RDN sequence
+	var names []pkix.AttributeTypeAndValue
+	for _, rdn := range name.ToRDNSequence() {
+		names = append(names, rdn...)
+	}
+
+	assert.True(t, matchSubject(names, subj))
+	assert.False(t, matchSubject(names[1:], subj))
+
+	_, err = parseHostSubject("XX=foo")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,93 @@
+package spice
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+)
+
+const (
+	SPICE_VIDEO_CODEC_TYPE_MJPEG = 1
+	SPICE_VIDEO_CODEC_TYPE_VP8   = 2
+	SPICE_VIDEO_CODEC_TYPE_H264  = 3
+	SPICE_VIDEO_CODEC_TYPE_VP9   = 4
+	SPICE_VIDEO_CODEC_TYPE_H265  = 5
+)
+
+// VideoDecoder decodes the frames of a video stream, in the order they are
+// received. A decoder is created for each stream and only used by it.
+type VideoDecoder interface {
+	Decode(frame []byte) (image.Image, error)
+}
+
+// videoCodec is a registered video codec
+type videoCodec struct {
+	typ uint8 // SPICE_VIDEO_CODEC_TYPE_*
+	new func() VideoDecoder
+}
+
+// WithVideoDecoder adds support for a video codec, one of
+// SPICE_VIDEO_CODEC_TYPE_*. newDecoder is called for each stream using it.
+// The server is asked to prefer codecs in the order they are registered.
+// MJPEG is always supported using image/jpeg, after registered codecs, but
+// can be replaced by registering SPICE_VIDEO_CODEC_TYPE_MJPEG.
+func WithVideoDecoder(codec uint8, newDecoder func() VideoDecoder) Option {
+	return func(cl *Client) {
+		for i, c := range cl.videoCodecs {
+			if c.typ == codec {
+				cl.videoCodecs[i].new = newDecoder
+				return
+			}
+		}
+		cl.videoCodecs = append(cl.videoCodecs, videoCodec{typ: codec, new: newDecoder})
+	}
+}
+
+// mjpegDecoder is the default MJPEG decoder, frames are plain JPEG images
+type mjpegDecoder struct{}
+
+func (mjpegDecoder) Decode(frame []byte) (image.Image, error) {
+	return jpeg.Decode(bytes.NewReader(frame))
+}
+
+// codecs returns the supported video codecs, in order of preference
+func (cl *Client) codecs() []videoCodec {
+	for _, c := range cl.videoCodecs {
+		if c.typ == SPICE_VIDEO_CODEC_TYPE_MJPEG {
+			return cl.videoCodecs
+		}
+	}
+	mjpeg := videoCodec{typ: SPICE_VIDEO_CODEC_TYPE_MJPEG, new: func() VideoDecoder { return mjpegDecoder{} }}
+	return append(cl.videoCodecs[:len(cl.videoCodecs):len(cl.videoCodecs)], mjpeg)
+}
+
+// videoDecoder returns a new decoder for codec, or nil if not supported
+func (cl *Client) videoDecoder(codec uint8) VideoDecoder {
+	for _, c := range cl.codecs() {
+		if c.typ == codec {
+			return c.new()
+		}
+	}
+	return nil
+}
+
+// codecCaps returns the display capabilities advertising the supported
+// video codecs
+func (cl *Client) codecCaps() []uint32 {
+	caps := []uint32{SPICE_DISPLAY_CAP_MULTI_CODEC, SPICE_DISPLAY_CAP_PREF_VIDEO_CODEC_TYPE}
+	for _, c := range cl.codecs() {
+		switch c.typ {
+		case SPICE_VIDEO_CODEC_TYPE_MJPEG:
+			caps = append(caps, SPICE_DISPLAY_CAP_CODEC_MJPEG)
+		case SPICE_VIDEO_CODEC_TYPE_VP8:
+			caps = append(caps, SPICE_DISPLAY_CAP_CODEC_VP8)
+		case SPICE_VIDEO_CODEC_TYPE_H264:
+			caps = append(caps, SPICE_DISPLAY_CAP_CODEC_H264)
+		case SPICE_VIDEO_CODEC_TYPE_VP9:
+			caps = append(caps, SPICE_DISPLAY_CAP_CODEC_VP9)
+		case SPICE_VIDEO_CODEC_TYPE_H265:
+			caps = append(caps, SPICE_DISPLAY_CAP_CODEC_H265)
+		}
+	}
+	return caps
+}
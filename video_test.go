@@ -0,0 +1,36 @@
+package spice
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testVideoDecoder struct{}
+
+func (testVideoDecoder) Decode(frame []byte) (image.Image, error) {
+	return image.NewRGBA(image.Rect(0, 0, 1, 1)), nil
+}
+
+func TestVideoCodecs(t *testing.T) {
+	// only MJPEG is supported by default
+	cl := &Client{}
+	assert.Equal(t, caps(SPICE_DISPLAY_CAP_MULTI_CODEC, SPICE_DISPLAY_CAP_PREF_VIDEO_CODEC_TYPE, SPICE_DISPLAY_CAP_CODEC_MJPEG), caps(cl.codecCaps()...))
+	assert.IsType(t, mjpegDecoder{}, cl.videoDecoder(SPICE_VIDEO_CODEC_TYPE_MJPEG))
+	assert.Nil(t, cl.videoDecoder(SPICE_VIDEO_CODEC_TYPE_VP8))
+
+	WithVideoDecoder(SPICE_VIDEO_CODEC_TYPE_H264, func() VideoDecoder { return testVideoDecoder{} })(cl)
+	var pref []uint8
+	for _, c := range cl.codecs() {
+		pref = append(pref, c.typ)
+	}
+	assert.Equal(t, []uint8{SPICE_VIDEO_CODEC_TYPE_H264, SPICE_VIDEO_CODEC_TYPE_MJPEG}, pref)
+	assert.True(t, testCap(caps(cl.codecCaps()...)[0], SPICE_DISPLAY_CAP_CODEC_H264))
+	assert.IsType(t, testVideoDecoder{}, cl.videoDecoder(SPICE_VIDEO_CODEC_TYPE_H264))
+
+	// registering MJPEG replaces the default decoder
+	WithVideoDecoder(SPICE_VIDEO_CODEC_TYPE_MJPEG, func() VideoDecoder { return testVideoDecoder{} })(cl)
+	assert.Len(t, cl.codecs(), 2)
+	assert.IsType(t, testVideoDecoder{}, cl.videoDecoder(SPICE_VIDEO_CODEC_TYPE_MJPEG))
+}